@@ -162,6 +162,18 @@ __DATA__
 ./server/go/blobserver/Makefile
     - server/go/httputil
     - lib/go/blobref
+    - lib/go/schema
+    - lib/go/blobserver
+    - lib/go/blobserver/localdisk
+    - lib/go/blobserver/packed
+    - lib/go/blobserver/memory
+    - lib/go/blobserver/s3
+    - lib/go/blobserver/replica
+    - lib/go/blobserver/cond
+    - lib/go/blobserver/encrypt
+    - lib/go/blobserver/remote
+    - lib/go/blobserver/gc
+    - lib/go/blobserver/share
     - server/go/auth
     - server/go/webserver
 ./server/go/sigserver/Makefile
@@ -207,5 +219,48 @@ __DATA__
     - lib/go/ext/openpgp/error
 ./lib/go/blobref/Makefile
     # (no deps)
+./lib/go/blobserver/Makefile
+    - lib/go/blobref
+./lib/go/blobserver/localdisk/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+./lib/go/blobserver/packed/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+./lib/go/blobserver/memory/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+./lib/go/blobserver/s3/Makefile
+    - lib/go/http
+    - lib/go/blobref
+    - lib/go/blobserver
+./lib/go/blobserver/replica/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+    - lib/go/blobserver/memory
+./lib/go/blobserver/cond/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+    - lib/go/blobserver/memory
+./lib/go/blobserver/encrypt/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+    - lib/go/blobserver/memory
+./lib/go/blobserver/remote/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+    - lib/go/client
+./lib/go/blobserver/gc/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+    - lib/go/blobserver/memory
+    - lib/go/jsonsign
+    - lib/go/schema
+./lib/go/blobserver/share/Makefile
+    - lib/go/blobref
+    - lib/go/blobserver
+    - lib/go/blobserver/memory
+    - lib/go/jsonsign
+    - lib/go/schema
 
 
@@ -34,6 +34,7 @@ import (
 	"camli/blobref"
 	"camli/client"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -42,7 +43,7 @@ import (
 
 var flagVerbose *bool = flag.Bool("verbose", false, "be verbose")
 
-var flagCheck *bool = flag.Bool("check", false, "just check for the existence of listed blobs; returning 0 if all our present")
+var flagCheck *bool = flag.Bool("check", false, "just check for the existence of listed blobs; returning 0 if all are present, 1 if any are missing, 2 on error")
 var flagOutput *string = flag.String("o", "-", "Output file/directory to create.  Use -f to overwrite.")
 var flagVia *string = flag.String("via", "", "Fetch the blob via the given comma-separated sharerefs (dev only).")
 
@@ -51,8 +52,7 @@ func main() {
 
 	client := client.NewOrFail()
 	if *flagCheck {
-		// Simply do HEAD requests checking if the blobs exists.
-		return
+		os.Exit(checkBlobs(client))
 	}
 
 	var w io.Writer = os.Stdout
@@ -97,3 +97,44 @@ func main() {
 	}
 
 }
+
+// checkBlobs stats the blobs named on the command line, reporting the
+// missing ones, and returns camget's exit status.
+func checkBlobs(c *client.Client) int {
+	blobs := make([]*blobref.BlobRef, flag.NArg())
+	for n := 0; n < flag.NArg(); n++ {
+		arg := flag.Arg(n)
+		blobs[n] = blobref.Parse(arg)
+		if blobs[n] == nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse argument \"%s\" as a blobref.\n", arg)
+			return 2
+		}
+	}
+
+	statChan := make(chan *blobref.SizedBlobRef)
+	errChan := make(chan os.Error, 1)
+	go func() {
+		errChan <- c.Stat(statChan, blobs)
+		close(statChan)
+	}()
+	have := make(map[string]bool)
+	for sb := range statChan {
+		have[sb.BlobRef.String()] = true
+		if *flagVerbose {
+			log.Printf("Present: %s (%d bytes)", sb.BlobRef, sb.Size)
+		}
+	}
+	if err := <-errChan; err != nil {
+		fmt.Fprintf(os.Stderr, "Error checking blobs: %v\n", err)
+		return 2
+	}
+
+	status := 0
+	for _, br := range blobs {
+		if !have[br.String()] {
+			fmt.Fprintf(os.Stderr, "Missing: %s\n", br)
+			status = 1
+		}
+	}
+	return status
+}
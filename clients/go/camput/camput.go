@@ -9,13 +9,12 @@ import (
 	"camli/client"
 	"camli/schema"
 	"camli/jsonsign"
-	"crypto/sha1"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"sort"
+	"time"
 )
 
 // Things that can be uploaded.  (at most one of these)
@@ -25,6 +24,8 @@ var flagPermanode = flag.Bool("permanode", false, "create a new permanode")
 var flagInit = flag.Bool("init", false, "first-time configuration.")
 var flagShare = flag.Bool("share", false, "create a camli share by haveref with the given blobrefs")
 var flagTransitive = flag.Bool("transitive", true, "share the transitive closure of the given blobrefs")
+var flagExpires = flag.Int64("expires", 0, "with --share, make the share expire after this many seconds; 0 for never")
+var flagRevoke = flag.Bool("revoke", false, "revoke the given share blobref with a signed claim")
 
 var flagVerbose = flag.Bool("verbose", false, "be verbose")
 
@@ -32,28 +33,22 @@ var wereErrors = false
 
 type Uploader struct {
 	*client.Client
-}
-
-func blobDetails(contents io.ReadSeeker) (bref *blobref.BlobRef, size int64, err os.Error) {
-	s1 := sha1.New()
-	contents.Seek(0, 0)
-	size, err = io.Copy(s1, contents)
-	if err == nil {
-		bref = blobref.FromHash("sha1", s1)
-	}
-	return
+	statHasher schema.StatHasher // hashes with the configured hash function
 }
 
 func (up *Uploader) UploadFileBlob(filename string) (*client.PutResult, os.Error) {
 	if *flagVerbose {
 		log.Printf("Uploading filename: %s", filename)
 	}
+	ref, err := up.statHasher.Hash(filename)
+	if err != nil {
+		return nil, err
+	}
 	file, err := os.Open(filename, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
-
-	ref, size, err := blobDetails(file)
+	size, err := file.Seek(0, 2)
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +58,7 @@ func (up *Uploader) UploadFileBlob(filename string) (*client.PutResult, os.Error
 }
 
 func (up *Uploader) UploadFile(filename string) (*client.PutResult, os.Error) {
-	fi, err := os.Lstat(filename)
+	fi, err := up.statHasher.Lstat(filename)
         if err != nil {
                 return nil, err
         }
@@ -173,8 +168,8 @@ func (up *Uploader) UploadNewPermanode() (*client.PutResult, os.Error) {
 	return up.Upload(client.NewUploadHandleFromString(signed))
 }
 
-func (up *Uploader) UploadShare(target *blobref.BlobRef, transitive bool) (*client.PutResult, os.Error) {
-	unsigned := schema.NewShareRef(schema.ShareHaveRef, target, transitive)
+func (up *Uploader) UploadShare(target *blobref.BlobRef, transitive bool, expires int64) (*client.PutResult, os.Error) {
+	unsigned := schema.NewShareRef(schema.ShareHaveRef, target, transitive, expires)
 
 	signed, err := up.SignMap(unsigned)
 	if err != nil {
@@ -193,6 +188,17 @@ func sumSet(flags ...*bool) (count int) {
 	return
 }
 
+func (up *Uploader) UploadShareRevocation(share *blobref.BlobRef) (*client.PutResult, os.Error) {
+	unsigned := schema.NewShareRevocationClaim(share)
+
+	signed, err := up.SignMap(unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	return up.Upload(client.NewUploadHandleFromString(signed))
+}
+
 func usage(msg string) {
 	if msg != "" {
 		fmt.Println("Error:", msg)
@@ -203,7 +209,8 @@ Usage: camput
   camput --init       # first time configuration
   camput --blob <filename(s) to upload as blobs>
   camput --file <filename(s) to upload as blobs + JSON metadata>
-  camput --share <blobref to share via haveref> [--transitive]
+  camput --share <blobref to share via haveref> [--transitive] [--expires=<seconds>]
+  camput --revoke <share blobref to revoke>
 `)
 	flag.PrintDefaults()
 	os.Exit(1)
@@ -225,16 +232,20 @@ func handleResult(what string, pr *client.PutResult, err os.Error) {
 func main() {
 	flag.Parse()
 
-	if sumSet(flagFile, flagBlob, flagPermanode, flagInit, flagShare) != 1 {
+	if sumSet(flagFile, flagBlob, flagPermanode, flagInit, flagShare, flagRevoke) != 1 {
 		// TODO: say which ones are conflicting
 		usage("Conflicting mode options.")
 	}
 
+	statHasher, err := schema.NewStatHasher(client.HashName())
+	if err != nil {
+		log.Exitf("%v", err)
+	}
 	client := client.NewOrFail()
 	if !*flagVerbose {
 		client.SetLogger(nil)
 	}
-	uploader := &Uploader{client}
+	uploader := &Uploader{client, statHasher}
 
 	switch {
 	case *flagInit:
@@ -264,8 +275,25 @@ func main() {
 		if br == nil {
 			log.Exitf("BlobRef is invalid: %q", flag.Arg(0))
 		}
-		pr, err := uploader.UploadShare(br, *flagTransitive)
+		if *flagExpires < 0 {
+			log.Exitf("--expires must not be negative")
+		}
+		expires := int64(0)
+		if *flagExpires > 0 {
+			expires = time.Nanoseconds() + *flagExpires*1e9
+		}
+		pr, err := uploader.UploadShare(br, *flagTransitive, expires)
 		handleResult("share", pr, err)
+	case *flagRevoke:
+		if flag.NArg() != 1 {
+			log.Exitf("--revoke only supports one blobref")
+		}
+		br := blobref.Parse(flag.Arg(0))
+		if br == nil {
+			log.Exitf("BlobRef is invalid: %q", flag.Arg(0))
+		}
+		pr, err := uploader.UploadShareRevocation(br)
+		handleResult("share revocation", pr, err)
 	}
 
 	if *flagVerbose {
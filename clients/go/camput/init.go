@@ -20,7 +20,6 @@ import (
 	"camli/blobref"
 	"camli/client"
 	"camli/jsonsign"
-	"crypto/sha1"
 	"exec"
 	"flag"
 	"os"
@@ -72,9 +71,10 @@ func doInit() {
                 log.Exitf("Error read from gpg to export public key: %v", err)
         }
 	
-	hash := sha1.New()
+	hashName := client.HashName()
+	hash := blobref.NewHash(hashName)
 	hash.Write(keyBytes)
-	bref := blobref.FromHash("sha1", hash)
+	bref := blobref.FromHash(hashName, hash)
 	
 	keyBlobPath := path.Join(blobDir, bref.String() + ".camli")
 	if err = ioutil.WriteFile(keyBlobPath, keyBytes, 0644); err != nil {
@@ -18,6 +18,7 @@ package blobref
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -30,6 +31,22 @@ var supportedDigests = map[string]func()hash.Hash{
 	"sha1": func() hash.Hash {
 		return sha1.New()
 	},
+	"sha224": func() hash.Hash {
+		return sha256.New224()
+	},
+	"sha256": func() hash.Hash {
+		return sha256.New()
+	},
+}
+
+// NewHash returns a new hash.Hash for the named hash function, such
+// as "sha1" or "sha256", or nil if it's not supported.
+func NewHash(hashName string) hash.Hash {
+	fn, ok := supportedDigests[hashName]
+	if !ok {
+		return nil
+	}
+	return fn()
 }
 
 type BlobRef struct {
@@ -37,6 +54,17 @@ type BlobRef struct {
 	digest    string
 }
 
+// SizedBlobRef is a BlobRef along with the size of the blob it
+// refers to.
+type SizedBlobRef struct {
+	*BlobRef
+	Size int64
+}
+
+func (sb *SizedBlobRef) String() string {
+	return fmt.Sprintf("[%s %d bytes]", sb.BlobRef.String(), sb.Size)
+}
+
 type ReadSeekCloser interface {
 	io.Reader
 	io.Seeker
@@ -56,11 +84,7 @@ func (o *BlobRef) String() string {
 }
 
 func (o *BlobRef) Hash() hash.Hash {
-	fn, ok := supportedDigests[o.hashName]
-	if !ok {
-		return nil
-	}
-	return fn()
+	return NewHash(o.hashName)
 }
 
 func (o *BlobRef) HashMatches(h hash.Hash) bool {
@@ -73,8 +97,10 @@ func (o *BlobRef) IsSupported() bool {
 }
 
 var kExpectedDigestSize = map[string]int{
-	"md5":  32,
-	"sha1": 40,
+	"md5":    32,
+	"sha1":   40,
+	"sha224": 56,
+	"sha256": 64,
 }
 
 func blobIfValid(hashname, digest string) *BlobRef {
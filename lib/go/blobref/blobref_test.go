@@ -55,3 +55,38 @@ func TestNotSupported(t *testing.T) {
 		t.Fatalf("Unexpected IsSupported() on unknownfunc")
 	}
 }
+
+func TestSHA2(t *testing.T) {
+	tests := []struct {
+		ref string
+		ok  bool
+	}{
+		{"sha224-0808f64e60d58979fcb676c96ec938270dea42445aeefcd3a4e6f8db", true},
+		{"sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", true},
+		{"sha256-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", false}, // wrong length
+	}
+	for _, tt := range tests {
+		br := Parse(tt.ref)
+		if (br != nil) != tt.ok {
+			t.Errorf("Parse(%q) = %v; want ok=%v", tt.ref, br, tt.ok)
+			continue
+		}
+		if br == nil {
+			continue
+		}
+		if !br.IsSupported() {
+			t.Errorf("%s should be supported", br.HashName())
+		}
+		hash := br.Hash()
+		hash.Write([]byte("foo"))
+		if !br.HashMatches(hash) {
+			t.Errorf("Expected hash of bytes 'foo' to match %s", tt.ref)
+		}
+		if got := FromHash(br.HashName(), hash).String(); got != tt.ref {
+			t.Errorf("FromHash = %s; want %s", got, tt.ref)
+		}
+	}
+	if NewHash("unknownfunc") != nil {
+		t.Errorf("NewHash of unknown hash function should be nil")
+	}
+}
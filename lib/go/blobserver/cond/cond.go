@@ -0,0 +1,317 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cond implements a blobserver.Storage that routes each
+// incoming blob to one of several other storages, based on rules
+// about the blob's contents, size or name.
+//
+// Fetches, stats and enumerations consult every target, so the
+// routing is invisible to readers.
+//
+// Example config, keeping schema blobs on local disk and everything
+// else in S3:
+//
+//   {"type": "cond",
+//    "rules": [
+//       {"isSchema": true, "then": {"type": "localdisk", "root": "/ssd/camli"}}
+//    ],
+//    "else": {"type": "s3", "bucket": "...", ...}}
+//
+// A rule may combine several conditions, all of which must hold:
+//
+//   isSchema    bool    blob starts with {"camliVersion" (see doc/schema/blob-magic.txt)
+//   minSize     int     blob is at least this many bytes
+//   maxSize     int     blob is at most this many bytes
+//   hashPrefix  string  blobref starts with this string, e.g. "sha1-0"
+//
+// The first matching rule wins.
+//
+// Rules are decided from at most maxPeekSize bytes held in memory.  If
+// a size condition needs more than that, blobs too long to decide from
+// the peek are first spooled to a temporary file to count them.
+package cond
+
+import (
+	"bytes"
+	"camli/blobref"
+	"camli/blobserver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// schemaPeekSize is how much of a blob is examined to decide whether
+// it's a schema blob, allowing for some whitespace before the
+// "camliVersion" key.
+const schemaPeekSize = 1024
+
+// maxPeekSize bounds how much of each incoming blob is buffered in
+// memory while choosing its target.
+const maxPeekSize = 64 << 10
+
+var schemaMagic = []byte(`"camliVersion"`)
+
+// A Rule sends blobs satisfying all of its non-zero conditions to
+// Target.
+type Rule struct {
+	IsSchema   bool
+	MinSize    int64
+	MaxSize    int64
+	HashPrefix string
+	Target     blobserver.Storage
+}
+
+type condStorage struct {
+	rules    []Rule
+	fallback blobserver.Storage
+	targets  []blobserver.Storage // distinct, in rule order, fallback last
+	peekSize int64
+	spool    bool // size rules need more than peekSize bytes
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("cond", newFromConfig)
+}
+
+func newFromConfig(config map[string]interface{}) (blobserver.Storage, os.Error) {
+	fallbackConfig, ok := config["else"].(map[string]interface{})
+	if !ok {
+		return nil, os.NewError("cond storage config requires an \"else\" storage object")
+	}
+	fallback, err := blobserver.CreateStorage(fallbackConfig)
+	if err != nil {
+		return nil, os.NewError(fmt.Sprintf("cond \"else\" storage: %v", err))
+	}
+	ruleConfigs, _ := config["rules"].([]interface{})
+	rules := make([]Rule, len(ruleConfigs))
+	for i, rc := range ruleConfigs {
+		m, ok := rc.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("cond rule %d isn't a JSON object", i))
+		}
+		if rules[i], err = ruleFromConfig(m); err != nil {
+			return nil, os.NewError(fmt.Sprintf("cond rule %d: %v", i, err))
+		}
+	}
+	return New(rules, fallback), nil
+}
+
+func ruleFromConfig(config map[string]interface{}) (rule Rule, err os.Error) {
+	targetConfig, ok := config["then"].(map[string]interface{})
+	if !ok {
+		return rule, os.NewError("missing \"then\" storage object")
+	}
+	if v, ok := config["isSchema"]; ok {
+		if rule.IsSchema, ok = v.(bool); !ok {
+			return rule, os.NewError("\"isSchema\" must be a boolean")
+		}
+	}
+	if rule.MinSize, err = blobserver.ConfigInt(config, "minSize", 0); err != nil {
+		return
+	}
+	if rule.MaxSize, err = blobserver.ConfigInt(config, "maxSize", 0); err != nil {
+		return
+	}
+	if v, ok := config["hashPrefix"]; ok {
+		if rule.HashPrefix, ok = v.(string); !ok {
+			return rule, os.NewError("\"hashPrefix\" must be a string")
+		}
+	}
+	if !rule.IsSchema && rule.MinSize == 0 && rule.MaxSize == 0 && rule.HashPrefix == "" {
+		return rule, os.NewError("rule has no conditions")
+	}
+	rule.Target, err = blobserver.CreateStorage(targetConfig)
+	return
+}
+
+// New returns a Storage sending each received blob to the Target of
+// the first matching rule, or to fallback if none match.
+func New(rules []Rule, fallback blobserver.Storage) blobserver.Storage {
+	cs := &condStorage{rules: rules, fallback: fallback}
+	seen := make(map[blobserver.Storage]bool)
+	addTarget := func(s blobserver.Storage) {
+		if !seen[s] {
+			seen[s] = true
+			cs.targets = append(cs.targets, s)
+		}
+	}
+	for _, rule := range rules {
+		addTarget(rule.Target)
+		if rule.IsSchema && cs.peekSize < schemaPeekSize {
+			cs.peekSize = schemaPeekSize
+		}
+		if rule.MinSize > cs.peekSize {
+			cs.peekSize = rule.MinSize
+		}
+		if rule.MaxSize > 0 && rule.MaxSize+1 > cs.peekSize {
+			cs.peekSize = rule.MaxSize + 1
+		}
+	}
+	addTarget(fallback)
+	if cs.peekSize > maxPeekSize {
+		cs.peekSize = maxPeekSize
+		cs.spool = true
+	}
+	return cs
+}
+
+// isSchemaBlob reports whether a blob beginning with peek looks like
+// a camli JSON blob.
+func isSchemaBlob(peek []byte) bool {
+	peek = skipSpace(peek)
+	if len(peek) == 0 || peek[0] != '{' {
+		return false
+	}
+	return bytes.HasPrefix(skipSpace(peek[1:]), schemaMagic)
+}
+
+func skipSpace(b []byte) []byte {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n') {
+		b = b[1:]
+	}
+	return b
+}
+
+// matches reports whether the rule holds for blob, whose first bytes
+// are peek.  size is the blob's total size, or -1 if it's only known
+// to be longer than peek.
+func (r *Rule) matches(blob *blobref.BlobRef, peek []byte, size int64) bool {
+	if r.IsSchema && !isSchemaBlob(peek) {
+		return false
+	}
+	n := size
+	if n < 0 {
+		n = int64(len(peek))
+	}
+	if r.MinSize > 0 && n < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && !(size >= 0 && size <= r.MaxSize) {
+		return false
+	}
+	if r.HashPrefix != "" && !strings.HasPrefix(blob.String(), r.HashPrefix) {
+		return false
+	}
+	return true
+}
+
+func (cs *condStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	peek := make([]byte, cs.peekSize)
+	n, err := io.ReadFull(source, peek)
+	size := int64(-1)
+	switch err {
+	case nil:
+	case os.EOF, io.ErrUnexpectedEOF:
+		size = int64(n)
+	default:
+		return nil, err
+	}
+	peek = peek[:n]
+	body := io.MultiReader(bytes.NewBuffer(peek), source)
+
+	if size < 0 && cs.spool {
+		file, err := ioutil.TempFile("", "camli-cond")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		if size, err = io.Copy(file, body); err != nil {
+			return nil, err
+		}
+		if _, err = file.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		body = file
+	}
+
+	target := cs.fallback
+	for i := range cs.rules {
+		if cs.rules[i].matches(blob, peek, size) {
+			target = cs.rules[i].Target
+			break
+		}
+	}
+	return target.ReceiveBlob(blob, body)
+}
+
+func (cs *condStorage) Fetch(blob *blobref.BlobRef) (file blobref.ReadSeekCloser, size int64, err os.Error) {
+	for _, target := range cs.targets {
+		file, size, err = target.Fetch(blob)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Stat asks each target in turn about the blobs not yet found, so a
+// blob stored in several targets is only reported once.
+func (cs *condStorage) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	need := make(map[string]*blobref.BlobRef)
+	for _, blob := range blobs {
+		need[blob.String()] = blob
+	}
+	for _, target := range cs.targets {
+		if len(need) == 0 {
+			break
+		}
+		ask := make([]*blobref.BlobRef, 0, len(need))
+		for _, blob := range need {
+			ask = append(ask, blob)
+		}
+		ch := make(chan *blobref.SizedBlobRef)
+		errch := make(chan os.Error, 1)
+		go func() {
+			errch <- target.Stat(ch, ask)
+			close(ch)
+		}()
+		for sb := range ch {
+			key := sb.BlobRef.String()
+			if _, ok := need[key]; ok {
+				need[key] = nil, false
+				dest <- sb
+			}
+		}
+		if err := <-errch; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cs *condStorage) BlobModTime(blob *blobref.BlobRef) (int64, os.Error) {
+	return blobserver.NewestModTime(cs.targets, blob)
+}
+
+func (cs *condStorage) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	sources := make([]blobserver.BlobEnumerator, len(cs.targets))
+	for i, target := range cs.targets {
+		sources[i] = target
+	}
+	return blobserver.MergedEnumerate(dest, sources, after, limit)
+}
+
+func (cs *condStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	for _, target := range cs.targets {
+		if err := target.RemoveBlobs(blobs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
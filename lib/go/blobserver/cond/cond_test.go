@@ -0,0 +1,186 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cond
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func refOf(s string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(s))
+	return blobref.FromHash("sha1", s1)
+}
+
+func has(s blobserver.Storage, blob *blobref.BlobRef) bool {
+	_, _, err := s.Fetch(blob)
+	return err == nil
+}
+
+func TestIsSchemaBlob(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{`{"camliVersion": 1}`, true},
+		{" \n{\n  \"camliVersion\": 1}", true},
+		{`{"camliType": "file", "camliVersion": 1}`, false},
+		{`camliVersion`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := isSchemaBlob([]byte(tt.in)); got != tt.want {
+			t.Errorf("isSchemaBlob(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	schemas, big, fallback := memory.New(), memory.New(), memory.New()
+	s := New([]Rule{
+		{IsSchema: true, Target: schemas},
+		{MinSize: 10, Target: big},
+	}, fallback)
+
+	blobs := map[string]blobserver.Storage{
+		`{"camliVersion": 1, "camliType": "permanode"}`: schemas,
+		"0123456789abcdef": big,
+		"small":            fallback,
+	}
+	for contents, want := range blobs {
+		blob := refOf(contents)
+		sb, err := s.ReceiveBlob(blob, strings.NewReader(contents))
+		if err != nil {
+			t.Fatalf("ReceiveBlob(%q): %v", contents, err)
+		}
+		if sb.Size != int64(len(contents)) {
+			t.Errorf("ReceiveBlob(%q) size = %d", contents, sb.Size)
+		}
+		if !has(want, blob) {
+			t.Errorf("blob %q not routed to the expected target", contents)
+		}
+		r, _, err := s.Fetch(blob)
+		if err != nil {
+			t.Fatalf("Fetch(%q): %v", contents, err)
+		}
+		got, _ := ioutil.ReadAll(r)
+		if string(got) != contents {
+			t.Errorf("Fetch = %q; want %q", got, contents)
+		}
+	}
+
+	ch := make(chan *blobref.SizedBlobRef)
+	go s.EnumerateBlobs(ch, "", 10)
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	if n != len(blobs) {
+		t.Errorf("enumerated %d blobs; want %d", n, len(blobs))
+	}
+}
+
+func TestSizeAndHashPrefix(t *testing.T) {
+	small, prefixed, fallback := memory.New(), memory.New(), memory.New()
+	foo := refOf("foo")
+	prefix := foo.String()[:len("sha1-")+2]
+	s := New([]Rule{
+		{MaxSize: 3, HashPrefix: "sha1-zz", Target: prefixed},
+		{MaxSize: 3, Target: small},
+		{HashPrefix: prefix, Target: prefixed},
+	}, fallback)
+
+	for _, contents := range []string{"foo", "four"} {
+		if _, err := s.ReceiveBlob(refOf(contents), strings.NewReader(contents)); err != nil {
+			t.Fatalf("ReceiveBlob(%q): %v", contents, err)
+		}
+	}
+	if !has(small, foo) {
+		t.Errorf("3 byte blob not in small storage")
+	}
+	if four := refOf("four"); strings.HasPrefix(four.String(), prefix) {
+		if !has(prefixed, four) {
+			t.Errorf("blob with hash prefix %s not in prefixed storage", prefix)
+		}
+	} else if !has(fallback, four) {
+		t.Errorf("4 byte blob not in fallback storage")
+	}
+}
+
+func TestSpoolLargeSizeRule(t *testing.T) {
+	big, fallback := memory.New(), memory.New()
+	s := New([]Rule{
+		{MinSize: maxPeekSize * 2, Target: big},
+	}, fallback)
+	if cs := s.(*condStorage); cs.peekSize != maxPeekSize || !cs.spool {
+		t.Fatalf("peekSize = %d, spool = %v; want %d, true", cs.peekSize, cs.spool, maxPeekSize)
+	}
+
+	blobs := map[string]blobserver.Storage{
+		strings.Repeat("a", maxPeekSize*2):   big,
+		strings.Repeat("b", maxPeekSize*2-1): fallback,
+		"small":                              fallback,
+	}
+	for contents, want := range blobs {
+		blob := refOf(contents)
+		sb, err := s.ReceiveBlob(blob, strings.NewReader(contents))
+		if err != nil {
+			t.Fatalf("ReceiveBlob(%d bytes): %v", len(contents), err)
+		}
+		if sb.Size != int64(len(contents)) {
+			t.Errorf("ReceiveBlob(%d bytes) size = %d", len(contents), sb.Size)
+		}
+		if !has(want, blob) {
+			t.Errorf("%d byte blob not routed to the expected target", len(contents))
+		}
+	}
+}
+
+func TestStatDedupe(t *testing.T) {
+	a, b := memory.New(), memory.New()
+	s := New([]Rule{{MaxSize: 3, Target: a}}, b)
+	foo := refOf("foo")
+	for _, target := range []blobserver.Storage{a, b} {
+		if _, err := target.ReceiveBlob(foo, strings.NewReader("foo")); err != nil {
+			t.Fatalf("ReceiveBlob: %v", err)
+		}
+	}
+
+	ch := make(chan *blobref.SizedBlobRef)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- s.Stat(ch, []*blobref.BlobRef{foo, refOf("missing")})
+		close(ch)
+	}()
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	if err := <-errch; err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Stat reported %d blobs; want 1", n)
+	}
+}
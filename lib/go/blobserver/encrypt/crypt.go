@@ -0,0 +1,115 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encrypt
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"io"
+	"os"
+)
+
+// Every blob written to the inner storage is a random IV, the contents
+// encrypted with AES in CTR mode, and an HMAC-SHA256 of the IV and
+// ciphertext.  The MAC is checked before any plaintext is handed out.
+const (
+	ivSize  = 16 // aes.BlockSize
+	macSize = 32 // sha256.Size
+)
+
+// deriveKey returns a key for the named purpose derived from the
+// configured key.
+func deriveKey(key []byte, purpose string) []byte {
+	h := sha256.New()
+	h.Write([]byte("camlistore encrypt " + purpose + " key\n"))
+	h.Write(key)
+	return h.Sum()
+}
+
+// encrypt writes the IV, the encryption of src and the MAC to dst,
+// returning the number of plaintext bytes.
+func encrypt(block cipher.Block, macKey []byte, dst io.Writer, src io.Reader) (int64, os.Error) {
+	iv := make([]byte, ivSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return 0, err
+	}
+	mac := hmac.NewSHA256(macKey)
+	mac.Write(iv)
+	if _, err := dst.Write(iv); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(&cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: io.MultiWriter(dst, mac)}, src)
+	if err != nil {
+		return n, err
+	}
+	_, err = dst.Write(mac.Sum())
+	return n, err
+}
+
+// decryptAll checks the MAC of a whole inner blob and returns its
+// plaintext, or false if the MAC doesn't match.
+func decryptAll(block cipher.Block, macKey []byte, data []byte) ([]byte, bool) {
+	if len(data) < ivSize+macSize {
+		return nil, false
+	}
+	body, sum := data[:len(data)-macSize], data[len(data)-macSize:]
+	mac := hmac.NewSHA256(macKey)
+	mac.Write(body)
+	if subtle.ConstantTimeCompare(sum, mac.Sum()) != 1 {
+		return nil, false
+	}
+	plain := make([]byte, len(body)-ivSize)
+	cipher.NewCTR(block, body[:ivSize]).XORKeyStream(plain, body[ivSize:])
+	return plain, true
+}
+
+// decryptTo reads an inner blob holding size bytes of plaintext from
+// r, writing the plaintext to dst while checking the blob's MAC and
+// that the plaintext is named by blob.  If those checks fail, dst has
+// been sent unverified bytes and must be discarded.
+func decryptTo(dst io.Writer, r io.Reader, block cipher.Block, macKey []byte, size int64, blob *blobref.BlobRef) os.Error {
+	hash := blob.Hash()
+	if hash == nil {
+		return os.NewError("unsupported blobref hash function")
+	}
+	iv := make([]byte, ivSize)
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return blobserver.CorruptBlobError
+	}
+	mac := hmac.NewSHA256(macKey)
+	mac.Write(iv)
+	plain := &cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: io.MultiWriter(hash, dst)}
+	if _, err := io.Copyn(io.MultiWriter(mac, plain), r, size); err != nil {
+		if err == os.EOF {
+			return blobserver.CorruptBlobError
+		}
+		return err
+	}
+	sum := make([]byte, macSize)
+	if _, err := io.ReadFull(r, sum); err != nil {
+		return blobserver.CorruptBlobError
+	}
+	if subtle.ConstantTimeCompare(sum, mac.Sum()) != 1 || !blob.HashMatches(hash) {
+		return blobserver.CorruptBlobError
+	}
+	return nil
+}
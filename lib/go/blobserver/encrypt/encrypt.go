@@ -0,0 +1,354 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encrypt implements a blobserver.Storage that encrypts blobs
+// before passing them to another, possibly untrusted, storage.
+//
+// Blobs are still addressed by the blobref of their plaintext, but the
+// inner storage only ever sees ciphertext blobs named by the digest of
+// the ciphertext.  For each blob a small encrypted "meta" blob records
+// which ciphertext blob holds it; these are read back at startup to
+// rebuild the mapping, which means fetching every inner blob small
+// enough to be one.  Both kinds of inner blob carry a MAC, checked when
+// meta blobs are loaded and on every Fetch, and fetched plaintext is
+// checked against its blobref, so a tampering inner storage can't
+// substitute contents.
+//
+// Example config:
+//
+//   {"type": "encrypt",
+//    "key": "000102030405060708090a0b0c0d0e0f",
+//    "backend": {"type": "s3", ...}}
+//
+// The key is a hex AES-128, -192 or -256 key.
+package encrypt
+
+import (
+	"bytes"
+	"camli/blobref"
+	"camli/blobserver"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metaMagic begins the plaintext of every meta blob.
+const metaMagic = "#camlistore/encrypt-meta=1\n"
+
+// maxMetaSize bounds the size of a meta blob in the inner storage;
+// larger inner blobs aren't examined when loading the index.
+const maxMetaSize = 1024
+
+type indexEntry struct {
+	size   int64            // of the plaintext
+	cipher *blobref.BlobRef // inner blob holding the contents
+	meta   *blobref.BlobRef // inner blob recording the mapping
+}
+
+type encryptStorage struct {
+	inner blobserver.Storage
+
+	// Meta blobs use keys derived from the data key, so a meta
+	// blob can't be forged by uploading a crafted plaintext.
+	dataBlock  cipher.Block
+	metaBlock  cipher.Block
+	dataMacKey []byte
+	metaMacKey []byte
+
+	mu    sync.RWMutex
+	index map[string]*indexEntry // plaintext blobref -> entry
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("encrypt", newFromConfig)
+}
+
+func newFromConfig(config map[string]interface{}) (blobserver.Storage, os.Error) {
+	hexKey, err := blobserver.ConfigString(config, "key", "")
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, os.NewError("encrypt storage \"key\" must be hex")
+	}
+	innerConfig, ok := config["backend"].(map[string]interface{})
+	if !ok {
+		return nil, os.NewError("encrypt storage config requires a \"backend\" storage object")
+	}
+	inner, err := blobserver.CreateStorage(innerConfig)
+	if err != nil {
+		return nil, os.NewError(fmt.Sprintf("encrypt backend: %v", err))
+	}
+	return New(inner, key)
+}
+
+// New returns a Storage encrypting blobs with the AES key before
+// storing them in inner.  It reads all of inner's meta blobs, so may
+// be slow for large inner storages.
+func New(inner blobserver.Storage, key []byte) (blobserver.Storage, os.Error) {
+	dataBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	metaBlock, err := aes.NewCipher(deriveKey(key, "meta")[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	es := &encryptStorage{
+		inner:      inner,
+		dataBlock:  dataBlock,
+		metaBlock:  metaBlock,
+		dataMacKey: deriveKey(key, "data mac"),
+		metaMacKey: deriveKey(key, "meta mac"),
+		index:      make(map[string]*indexEntry),
+	}
+	if err := es.loadIndex(); err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+// loadIndex finds the meta blobs among the inner blobs.  Since they're
+// encrypted, the only way to tell them apart is to fetch and try to
+// decrypt every inner blob of maxMetaSize bytes or less, so opening a
+// storage with many small blobs is slow.
+func (es *encryptStorage) loadIndex() os.Error {
+	candidates := make([]*blobref.BlobRef, 0)
+	err := blobserver.EnumerateAll(es.inner, func(sb *blobref.SizedBlobRef) {
+		if sb.Size <= maxMetaSize {
+			candidates = append(candidates, sb.BlobRef)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, metaRef := range candidates {
+		if err := es.loadMeta(metaRef); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMeta adds the entry in metaRef to the index, if metaRef is a
+// meta blob.
+func (es *encryptStorage) loadMeta(metaRef *blobref.BlobRef) os.Error {
+	rsc, _, err := es.inner.Fetch(metaRef)
+	if err != nil {
+		return err
+	}
+	defer rsc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rsc, maxMetaSize+1))
+	if err != nil {
+		return err
+	}
+	plain, ok := decryptAll(es.metaBlock, es.metaMacKey, data)
+	if !ok || !bytes.HasPrefix(plain, []byte(metaMagic)) {
+		return nil // a data blob, or not ours
+	}
+	fields := strings.Fields(string(plain[len(metaMagic):]))
+	if len(fields) != 3 {
+		log.Printf("encrypt: ignoring malformed meta blob %s", metaRef)
+		return nil
+	}
+	blob, cipherRef := blobref.Parse(fields[0]), blobref.Parse(fields[2])
+	blobSize, err := strconv.Atoi64(fields[1])
+	if blob == nil || cipherRef == nil || err != nil {
+		log.Printf("encrypt: ignoring malformed meta blob %s", metaRef)
+		return nil
+	}
+	es.index[blob.String()] = &indexEntry{size: blobSize, cipher: cipherRef, meta: metaRef}
+	return nil
+}
+
+func (es *encryptStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	hash := blob.Hash()
+	if hash == nil {
+		return nil, os.NewError("unsupported blobref hash function")
+	}
+
+	es.mu.RLock()
+	_, have := es.index[blob.String()]
+	es.mu.RUnlock()
+	if have {
+		size, err := io.Copy(hash, source)
+		if err != nil {
+			return nil, err
+		}
+		if !blob.HashMatches(hash) {
+			return nil, blobserver.CorruptBlobError
+		}
+		return &blobref.SizedBlobRef{BlobRef: blob, Size: size}, nil
+	}
+
+	// The ciphertext's name isn't known until it's all been
+	// written, so spool it to disk first.
+	tempFile, err := ioutil.TempFile("", "camli-encrypt")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	// Name the ciphertext with the same hash function as the
+	// plaintext.
+	cipherHash := blob.Hash()
+	size, err := encrypt(es.dataBlock, es.dataMacKey, io.MultiWriter(tempFile, cipherHash), io.TeeReader(source, hash))
+	if err != nil {
+		return nil, err
+	}
+	if !blob.HashMatches(hash) {
+		return nil, blobserver.CorruptBlobError
+	}
+	if _, err = tempFile.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	cipherRef := blobref.FromHash(blob.HashName(), cipherHash)
+	if _, err = es.inner.ReceiveBlob(cipherRef, tempFile); err != nil {
+		return nil, err
+	}
+
+	var meta, metaCipher bytes.Buffer
+	fmt.Fprintf(&meta, "%s%s %d %s\n", metaMagic, blob, size, cipherRef)
+	if _, err = encrypt(es.metaBlock, es.metaMacKey, &metaCipher, &meta); err != nil {
+		return nil, err
+	}
+	metaHash := blob.Hash()
+	metaHash.Write(metaCipher.Bytes())
+	metaRef := blobref.FromHash(blob.HashName(), metaHash)
+	if _, err = es.inner.ReceiveBlob(metaRef, &metaCipher); err != nil {
+		return nil, err
+	}
+
+	es.mu.Lock()
+	es.index[blob.String()] = &indexEntry{size: size, cipher: cipherRef, meta: metaRef}
+	es.mu.Unlock()
+	return &blobref.SizedBlobRef{BlobRef: blob, Size: size}, nil
+}
+
+// Fetch decrypts the whole blob into an unlinked temporary file,
+// checking it as it goes, so what's returned is exactly what was
+// verified even if the inner storage changes it afterwards.
+func (es *encryptStorage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	es.mu.RLock()
+	e, ok := es.index[blob.String()]
+	es.mu.RUnlock()
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	rsc, innerSize, err := es.inner.Fetch(e.cipher)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rsc.Close()
+	if innerSize != ivSize+e.size+macSize {
+		return nil, 0, blobserver.CorruptBlobError
+	}
+	spool, err := ioutil.TempFile("", "camli-encrypt")
+	if err != nil {
+		return nil, 0, err
+	}
+	os.Remove(spool.Name()) // still readable until closed
+	if err = decryptTo(spool, rsc, es.dataBlock, es.dataMacKey, e.size, blob); err != nil {
+		spool.Close()
+		return nil, 0, err
+	}
+	if _, err = spool.Seek(0, 0); err != nil {
+		spool.Close()
+		return nil, 0, err
+	}
+	return spool, e.size, nil
+}
+
+// BlobModTime reports when blob's meta blob, the last of its inner
+// blobs to be written, was stored.
+func (es *encryptStorage) BlobModTime(blob *blobref.BlobRef) (int64, os.Error) {
+	es.mu.RLock()
+	e, ok := es.index[blob.String()]
+	es.mu.RUnlock()
+	if !ok {
+		return 0, os.ENOENT
+	}
+	return blobserver.NewestModTime([]blobserver.Storage{es.inner}, e.meta)
+}
+
+func (es *encryptStorage) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	for _, blob := range blobs {
+		if e, ok := es.index[blob.String()]; ok {
+			dest <- &blobref.SizedBlobRef{BlobRef: blob, Size: e.size}
+		}
+	}
+	return nil
+}
+
+func (es *encryptStorage) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	defer close(dest)
+	es.mu.RLock()
+	keys := make([]string, 0, len(es.index))
+	for key := range es.index {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.SortStrings(keys)
+	if uint(len(keys)) > limit {
+		keys = keys[:limit]
+	}
+	sizes := make([]int64, len(keys))
+	for i, key := range keys {
+		sizes[i] = es.index[key].size
+	}
+	es.mu.RUnlock()
+
+	for i, key := range keys {
+		dest <- &blobref.SizedBlobRef{BlobRef: blobref.Parse(key), Size: sizes[i]}
+	}
+	return nil
+}
+
+func (es *encryptStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	metas := make([]*blobref.BlobRef, 0, len(blobs))
+	ciphers := make([]*blobref.BlobRef, 0, len(blobs))
+	for _, blob := range blobs {
+		if e, ok := es.index[blob.String()]; ok {
+			metas = append(metas, e.meta)
+			ciphers = append(ciphers, e.cipher)
+		}
+	}
+	// Remove the meta blobs first so a failure part way can't
+	// leave one pointing at a missing ciphertext blob.
+	if err := es.inner.RemoveBlobs(metas); err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		es.index[blob.String()] = nil, false
+	}
+	return es.inner.RemoveBlobs(ciphers)
+}
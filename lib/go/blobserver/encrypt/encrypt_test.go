@@ -0,0 +1,250 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encrypt
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+func refOf(s string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(s))
+	return blobref.FromHash("sha1", s1)
+}
+
+func fetchString(t *testing.T, s blobserver.Storage, blob *blobref.BlobRef) string {
+	r, _, err := s.Fetch(blob)
+	if err != nil {
+		t.Fatalf("Fetch(%s): %v", blob, err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %s: %v", blob, err)
+	}
+	return string(b)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	inner := memory.New()
+	s, err := New(inner, testKey)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	secret := strings.Repeat("attack at dawn. ", 10)
+	blob := refOf(secret)
+	if _, err := s.ReceiveBlob(blob, strings.NewReader("attack at noon")); err != blobserver.CorruptBlobError {
+		t.Errorf("expected CorruptBlobError; got %v", err)
+	}
+	sb, err := s.ReceiveBlob(blob, strings.NewReader(secret))
+	if err != nil {
+		t.Fatalf("ReceiveBlob: %v", err)
+	}
+	if sb.Size != int64(len(secret)) {
+		t.Errorf("size = %d; want %d", sb.Size, len(secret))
+	}
+	if got := fetchString(t, s, blob); got != secret {
+		t.Errorf("Fetch = %q", got)
+	}
+
+	// The inner storage shouldn't see the plaintext or its name.
+	ch := make(chan *blobref.SizedBlobRef)
+	go inner.EnumerateBlobs(ch, "", 100)
+	n := 0
+	for isb := range ch {
+		n++
+		if isb.BlobRef.String() == blob.String() {
+			t.Errorf("inner storage has blob named by plaintext ref")
+		}
+		if strings.Contains(fetchString(t, inner, isb.BlobRef), "attack") {
+			t.Errorf("inner blob %s contains plaintext", isb.BlobRef)
+		}
+	}
+	if n != 2 {
+		t.Errorf("inner storage has %d blobs; want data and meta blob", n)
+	}
+
+	// Seeking into the middle of a blob, not on a block boundary.
+	r, _, _ := s.Fetch(blob)
+	r.Seek(21, 0)
+	buf := make([]byte, 10)
+	r.Read(buf)
+	if string(buf) != secret[21:31] {
+		t.Errorf("read after seek = %q; want %q", buf, secret[21:31])
+	}
+	r.Close()
+
+	// A new wrapper over the same inner storage rebuilds the index.
+	s2, err := New(inner, testKey)
+	if err != nil {
+		t.Fatalf("New after restart: %v", err)
+	}
+	if got := fetchString(t, s2, blob); got != secret {
+		t.Errorf("Fetch after restart = %q", got)
+	}
+	ech := make(chan *blobref.SizedBlobRef)
+	go s2.EnumerateBlobs(ech, "", 10)
+	for esb := range ech {
+		if esb.BlobRef.String() != blob.String() || esb.Size != int64(len(secret)) {
+			t.Errorf("unexpected enumerate result %v", esb)
+		}
+	}
+
+	// With the wrong key, nothing is found.
+	s3, err := New(inner, []byte("fedcba9876543210"))
+	if err != nil {
+		t.Fatalf("New with other key: %v", err)
+	}
+	if _, _, err := s3.Fetch(blob); err == nil {
+		t.Errorf("expected Fetch with wrong key to fail")
+	}
+
+	if err := s2.RemoveBlobs([]*blobref.BlobRef{blob}); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	ch = make(chan *blobref.SizedBlobRef)
+	go inner.EnumerateBlobs(ch, "", 100)
+	for isb := range ch {
+		t.Errorf("inner blob %s left after remove", isb.BlobRef)
+	}
+}
+
+// tamperStorage flips a bit in the first ciphertext byte of every
+// inner blob it serves.
+type tamperStorage struct {
+	blobserver.Storage
+}
+
+type tamperedBlob []byte
+
+func (b tamperedBlob) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	if off >= int64(len(b)) {
+		return 0, os.EOF
+	}
+	n = copy(p, b[off:])
+	if n < len(p) {
+		err = os.EOF
+	}
+	return
+}
+
+type tamperedReader struct {
+	*io.SectionReader
+}
+
+func (tamperedReader) Close() os.Error {
+	return nil
+}
+
+func (ts tamperStorage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	rsc, _, err := ts.Storage.Fetch(blob)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rsc.Close()
+	b, err := ioutil.ReadAll(rsc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b) > ivSize {
+		b[ivSize] ^= 1
+	}
+	size := int64(len(b))
+	return tamperedReader{io.NewSectionReader(tamperedBlob(b), 0, size)}, size, nil
+}
+
+func TestTamperedInnerBlobs(t *testing.T) {
+	inner := memory.New()
+	s, err := New(inner, testKey)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	blob := refOf("attack at dawn")
+	if _, err := s.ReceiveBlob(blob, strings.NewReader("attack at dawn")); err != nil {
+		t.Fatalf("ReceiveBlob: %v", err)
+	}
+
+	// With a tampered meta blob the index entry is never loaded.
+	if s2, err := New(tamperStorage{inner}, testKey); err != nil {
+		t.Fatalf("New over tampered storage: %v", err)
+	} else if _, _, err := s2.Fetch(blob); err != os.ENOENT {
+		t.Errorf("Fetch with tampered meta blob = %v; want ENOENT", err)
+	}
+
+	// With a tampered data blob Fetch refuses to return contents.
+	s.(*encryptStorage).inner = tamperStorage{inner}
+	if _, _, err := s.Fetch(blob); err != blobserver.CorruptBlobError {
+		t.Errorf("Fetch of tampered data blob = %v; want CorruptBlobError", err)
+	}
+}
+
+// switchingStorage serves genuine inner blobs until they're rewound,
+// then tampered ones, like an inner storage changing a blob between
+// reads.
+type switchingStorage struct {
+	blobserver.Storage
+}
+
+type switchingReader struct {
+	blobref.ReadSeekCloser
+	tampered blobref.ReadSeekCloser
+}
+
+func (sr *switchingReader) Seek(offset int64, whence int) (int64, os.Error) {
+	sr.ReadSeekCloser = sr.tampered
+	return sr.tampered.Seek(offset, whence)
+}
+
+func (ss switchingStorage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	good, size, err := ss.Storage.Fetch(blob)
+	if err != nil {
+		return nil, 0, err
+	}
+	bad, _, err := tamperStorage{ss.Storage}.Fetch(blob)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &switchingReader{good, bad}, size, nil
+}
+
+func TestInnerBlobChangesDuringFetch(t *testing.T) {
+	inner := memory.New()
+	s, err := New(inner, testKey)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	secret := strings.Repeat("attack at dawn. ", 10)
+	blob := refOf(secret)
+	if _, err := s.ReceiveBlob(blob, strings.NewReader(secret)); err != nil {
+		t.Fatalf("ReceiveBlob: %v", err)
+	}
+	s.(*encryptStorage).inner = switchingStorage{inner}
+	if got := fetchString(t, s, blob); got != secret {
+		t.Errorf("Fetch returned %q; want the verified contents", got)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gc implements a mark-and-sweep garbage collector for blob
+// storage.
+//
+// The roots are signed "permanode" and "keep" schema blobs (see
+// doc/schema/objects) and signed "share-revocation" claims.  From
+// those it follows the references in file contentParts, directory
+// entries, static-set members, share and keep targets, and signers'
+// public keys.  Signed claims about a reachable
+// permanode are reachable too, along with what they refer to.
+// Everything else is garbage.
+package gc
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonsign"
+	"camli/schema"
+	"log"
+	"os"
+	"time"
+)
+
+type Collector struct {
+	Storage blobserver.Storage
+
+	// Grace is how long ago, in nanoseconds, a blob must have been
+	// stored before it can be removed.  Blobs stored more recently
+	// are treated as roots, protecting uploads in progress whose
+	// referencing roots haven't arrived yet.  A non-zero Grace
+	// requires Storage to be a blobserver.BlobModTimer.
+	Grace int64
+
+	// DryRun reports the garbage, subject to Grace, without
+	// removing anything.
+	DryRun bool
+
+	// VerifySignature reports whether a signed schema blob's
+	// signature is valid.  If nil, it's checked with jsonsign,
+	// fetching public keys from Storage.
+	VerifySignature func(sjson string) bool
+}
+
+type Result struct {
+	Roots     []*blobref.BlobRef
+	Reachable int
+
+	// Young is how many otherwise unreachable blobs were kept
+	// because they, or a blob referring to them, were stored less
+	// than Grace ago.
+	Young int
+
+	// Garbage lists the unreachable blobs.  Unless DryRun was set,
+	// they've been removed.
+	Garbage []*blobref.SizedBlobRef
+}
+
+// isSigned reports whether b carries a signature.
+func isSigned(b *schema.Blob) bool {
+	return b.StringField("camliSigner") != "" && b.StringField("camliSig") != ""
+}
+
+// Collect finds, and unless c.DryRun is set removes, all blobs that
+// aren't reachable from a root.
+func (c *Collector) Collect() (*Result, os.Error) {
+	res, garbage, err := c.mark()
+	if err != nil {
+		return nil, err
+	}
+	if c.DryRun {
+		res.Garbage = garbage
+		return res, nil
+	}
+
+	if len(garbage) > 0 {
+		refs := make([]*blobref.BlobRef, len(garbage))
+		for i, sb := range garbage {
+			refs[i] = sb.BlobRef
+		}
+		if err := c.Storage.RemoveBlobs(refs); err != nil {
+			return nil, err
+		}
+		log.Printf("gc: removed %d blobs", len(garbage))
+	}
+	res.Garbage = garbage
+	return res, nil
+}
+
+func (c *Collector) verify(b *schema.Blob) bool {
+	if c.VerifySignature != nil {
+		return c.VerifySignature(string(b.Raw))
+	}
+	vr := jsonsign.NewVerificationRequest(string(b.Raw), c.Storage)
+	if !vr.Verify() {
+		log.Printf("gc: ignoring signed blob with bad signature: %v", vr.Err)
+		return false
+	}
+	return true
+}
+
+func (c *Collector) enumerateAll() ([]*blobref.SizedBlobRef, os.Error) {
+	all := make([]*blobref.SizedBlobRef, 0)
+	err := blobserver.EnumerateAll(c.Storage, func(sb *blobref.SizedBlobRef) {
+		all = append(all, sb)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// youngBlobs returns the set of blobs in all stored less than c.Grace
+// ago.
+func (c *Collector) youngBlobs(all []*blobref.SizedBlobRef) (map[string]bool, os.Error) {
+	young := make(map[string]bool)
+	if c.Grace <= 0 {
+		return young, nil
+	}
+	mt, ok := c.Storage.(blobserver.BlobModTimer)
+	if !ok {
+		return nil, os.NewError("gc: storage can't tell when blobs were stored, so a grace period can't be honored")
+	}
+	cutoff := time.Nanoseconds() - c.Grace
+	for _, sb := range all {
+		mtime, err := mt.BlobModTime(sb.BlobRef)
+		if err == os.ENOENT {
+			// Removed since it was enumerated.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mtime > cutoff {
+			young[sb.BlobRef.String()] = true
+		}
+	}
+	return young, nil
+}
+
+// mark returns the roots, the number of reachable and young blobs,
+// and the unreachable blobs.
+func (c *Collector) mark() (*Result, []*blobref.SizedBlobRef, os.Error) {
+	all, err := c.enumerateAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	young, err := c.youngBlobs(all)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	schemas := make(map[string]*schema.Blob)
+	for _, sb := range all {
+		if sb.Size > schema.MaxSchemaBlobSize {
+			continue
+		}
+		b, err := schema.FetchBlob(c.Storage, sb.BlobRef)
+		if _, ok := err.(*schema.NotSchemaError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		schemas[sb.BlobRef.String()] = b
+	}
+
+	// reachable maps each marked blob to the phase that marked it:
+	// fromRoots, or fromYoung for blobs only kept by young ones.
+	const (
+		fromRoots = 1 + iota
+		fromYoung
+	)
+	phase := fromRoots
+	res := &Result{Roots: make([]*blobref.BlobRef, 0)}
+	reachable := make(map[string]int)
+	queue := make([]string, 0)
+	markRef := func(ref string) {
+		if reachable[ref] == 0 {
+			reachable[ref] = phase
+			queue = append(queue, ref)
+		}
+	}
+	walk := func() {
+		for len(queue) > 0 {
+			ref := queue[0]
+			queue = queue[1:]
+			if b, ok := schemas[ref]; ok {
+				for _, r := range b.AllRefs() {
+					markRef(r)
+				}
+			}
+		}
+	}
+
+	claims := make([]string, 0)
+	for ref, b := range schemas {
+		switch b.Type() {
+		case "permanode", "keep":
+			if isSigned(b) && c.verify(b) {
+				res.Roots = append(res.Roots, blobref.Parse(ref))
+				markRef(ref)
+			}
+		case "claim":
+			if !isSigned(b) {
+				break
+			}
+			// Share revocations must outlive the shares they
+			// revoke, so they're roots too.
+			if b.StringField("claimType") == schema.ShareRevocationClaim {
+				if c.verify(b) {
+					res.Roots = append(res.Roots, blobref.Parse(ref))
+					markRef(ref)
+				}
+				break
+			}
+			claims = append(claims, ref)
+		}
+	}
+
+	// Claims keep their contents alive as long as the permanode
+	// they're about is alive, which may only become known after
+	// walking what other claims refer to.
+	verifiedClaims := make(map[string]bool)
+	markClaims := func() {
+		for changed := true; changed; {
+			changed = false
+			for _, ref := range claims {
+				if reachable[ref] != 0 {
+					continue
+				}
+				pn := schemas[ref].StringField("permaNode")
+				if pn == "" || reachable[pn] == 0 {
+					continue
+				}
+				if _, checked := verifiedClaims[ref]; !checked {
+					verifiedClaims[ref] = c.verify(schemas[ref])
+				}
+				if verifiedClaims[ref] {
+					markRef(ref)
+					walk()
+					changed = true
+				}
+			}
+		}
+	}
+	walk()
+	markClaims()
+
+	// Young blobs may belong to uploads whose roots haven't arrived
+	// yet, so they keep what they refer to alive.
+	phase = fromYoung
+	for ref, _ := range young {
+		markRef(ref)
+	}
+	walk()
+	markClaims()
+
+	garbage := make([]*blobref.SizedBlobRef, 0)
+	for _, sb := range all {
+		switch reachable[sb.BlobRef.String()] {
+		case fromRoots:
+			res.Reachable++
+		case fromYoung:
+			res.Young++
+		default:
+			garbage = append(garbage, sb)
+		}
+	}
+	return res, garbage, nil
+}
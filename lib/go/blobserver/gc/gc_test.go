@@ -0,0 +1,185 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gc
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testStore struct {
+	t       *testing.T
+	storage blobserver.Storage
+}
+
+func (ts *testStore) add(contents string) string {
+	s1 := sha1.New()
+	s1.Write([]byte(contents))
+	ref := blobref.FromHash("sha1", s1)
+	if _, err := ts.storage.ReceiveBlob(ref, strings.NewReader(contents)); err != nil {
+		ts.t.Fatalf("ReceiveBlob: %v", err)
+	}
+	return ref.String()
+}
+
+// signed fakes a signed schema blob; fakeVerify accepts camliSig
+// "good" only.
+func (ts *testStore) signed(json string, good bool) string {
+	sig := "bad"
+	if good {
+		sig = "good"
+	}
+	return ts.add(fmt.Sprintf(`%s,"camliSigner":%q,"camliSig":%q}`, json, ts.signer(), sig))
+}
+
+func (ts *testStore) signer() string {
+	return ts.add("-----BEGIN PGP PUBLIC KEY BLOCK-----\nfake\n")
+}
+
+func fakeVerify(sjson string) bool {
+	return strings.HasSuffix(sjson, `"camliSig":"good"}`)
+}
+
+func TestCollect(t *testing.T) {
+	ts := &testStore{t: t, storage: memory.New()}
+
+	chunk1 := ts.add("chunk one")
+	chunk2 := ts.add("chunk two")
+	file := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "size": 18,
+  "contentParts": [{"blobRef": %q, "size": 9}, {"blobRef": %q, "size": 9}]}`, chunk1, chunk2))
+	set := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "static-set", "members": [%q]}`, file))
+	dir := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "directory", "fileName": "d", "entries": %q}`, set))
+	keep := ts.signed(fmt.Sprintf(`{"camliVersion":1,"camliType":"keep","target":%q`, dir), true)
+
+	shared := ts.add("shared bytes")
+	share := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "share", "authType": "haveref", "target": %q}`, shared))
+	pn := ts.signed(`{"camliVersion":1,"camliType":"permanode","random":"x"`, true)
+	claim := ts.signed(fmt.Sprintf(`{"camliVersion":1,"camliType":"claim","claimType":"permanode-become","permaNode":%q,"contents":%q`, pn, share), true)
+
+	forgedTarget := ts.add("kept by a forged keep")
+	forged := ts.signed(fmt.Sprintf(`{"camliVersion":1,"camliType":"keep","target":%q`, forgedTarget), false)
+	unsignedTarget := ts.add("kept by an unsigned keep")
+	unsigned := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "keep", "target": %q}`, unsignedTarget))
+	orphan := ts.add("nobody loves me")
+	orphanPn := ts.add(`{"camliVersion": 1, "camliType": "permanode", "random": "unsigned"}`)
+	orphanClaim := ts.signed(fmt.Sprintf(`{"camliVersion":1,"camliType":"claim","permaNode":%q,"contents":%q`, orphanPn, orphan), true)
+
+	revokedShare := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "share", "authType": "haveref", "target": %q}`, orphan))
+	revocation := ts.signed(fmt.Sprintf(`{"camliVersion":1,"camliType":"claim","claimType":"share-revocation","target":%q`, revokedShare), true)
+
+	live := []string{chunk1, chunk2, file, set, dir, keep, shared, share, pn, claim, revocation, ts.signer()}
+	dead := []string{forgedTarget, forged, unsignedTarget, unsigned, orphan, orphanPn, orphanClaim, revokedShare}
+
+	c := &Collector{Storage: ts.storage, DryRun: true, VerifySignature: fakeVerify}
+	res, err := c.Collect()
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(res.Roots) != 3 {
+		t.Errorf("found %d roots; want 3 (the keep, the permanode and the revocation)", len(res.Roots))
+	}
+	if res.Reachable != len(live) {
+		t.Errorf("reachable = %d; want %d", res.Reachable, len(live))
+	}
+	garbage := make(map[string]bool)
+	for _, sb := range res.Garbage {
+		garbage[sb.BlobRef.String()] = true
+	}
+	for _, ref := range dead {
+		if !garbage[ref] {
+			t.Errorf("%s not reported as garbage", ref)
+		}
+	}
+	if len(garbage) != len(dead) {
+		t.Errorf("%d garbage blobs; want %d", len(garbage), len(dead))
+	}
+	if _, _, err := ts.storage.Fetch(blobref.Parse(orphan)); err != nil {
+		t.Errorf("dry run removed a blob")
+	}
+
+	c.DryRun = false
+	if _, err := c.Collect(); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	for _, ref := range live {
+		if _, _, err := ts.storage.Fetch(blobref.Parse(ref)); err != nil {
+			t.Errorf("live blob %s was removed", ref)
+		}
+	}
+	for _, ref := range dead {
+		if _, _, err := ts.storage.Fetch(blobref.Parse(ref)); err == nil {
+			t.Errorf("garbage blob %s wasn't removed", ref)
+		}
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	ts := &testStore{t: t, storage: memory.New()}
+	oldChunk := ts.add("uploaded long ago")
+	oldOrphan := ts.add("nobody loves me")
+	youngOrphan := ts.add("root still to come")
+	file := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "size": 17,
+  "contentParts": [{"blobRef": %q, "size": 17}]}`, oldChunk))
+
+	as := &agedStorage{Storage: ts.storage, old: map[string]bool{oldChunk: true, oldOrphan: true}}
+	c := &Collector{Storage: as, Grace: 3600e9, VerifySignature: fakeVerify}
+	for _, dryRun := range []bool{true, false} {
+		c.DryRun = dryRun
+		res, err := c.Collect()
+		if err != nil {
+			t.Fatalf("Collect (dry run %v): %v", dryRun, err)
+		}
+		if len(res.Garbage) != 1 || res.Garbage[0].BlobRef.String() != oldOrphan {
+			t.Errorf("dry run %v: garbage = %v; want just the old orphan", dryRun, res.Garbage)
+		}
+		if res.Young != 3 {
+			t.Errorf("dry run %v: young = %d; want 3", dryRun, res.Young)
+		}
+	}
+	for _, ref := range []string{oldChunk, youngOrphan, file} {
+		if _, _, err := ts.storage.Fetch(blobref.Parse(ref)); err != nil {
+			t.Errorf("young blob, or blob a young one refers to, %s was removed", ref)
+		}
+	}
+	if _, _, err := ts.storage.Fetch(blobref.Parse(oldOrphan)); err == nil {
+		t.Errorf("old orphan survived")
+	}
+
+	c = &Collector{Storage: struct{ blobserver.Storage }{ts.storage}, Grace: 3600e9, VerifySignature: fakeVerify}
+	if _, err := c.Collect(); err == nil {
+		t.Errorf("Collect with a grace period on storage without blob times succeeded")
+	}
+}
+
+// agedStorage reports the blobs in old as stored at the epoch.
+type agedStorage struct {
+	blobserver.Storage
+	old map[string]bool
+}
+
+func (as *agedStorage) BlobModTime(blob *blobref.BlobRef) (int64, os.Error) {
+	if as.old[blob.String()] {
+		return 0, nil
+	}
+	return as.Storage.(blobserver.BlobModTimer).BlobModTime(blob)
+}
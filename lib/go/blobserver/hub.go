@@ -0,0 +1,91 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"camli/blobref"
+	"sync"
+)
+
+// BlobHub announces newly received blobs to in-process listeners,
+// such as long-polling enumerate requests, indexers and replicators.
+type BlobHub interface {
+	// NotifyBlobReceived tells all listeners about blob.
+	NotifyBlobReceived(blob *blobref.BlobRef)
+
+	// RegisterListener adds ch to the channels sent each newly
+	// received blob.  Notification never blocks: if ch is full,
+	// the blob is dropped for that listener, so listeners should
+	// use a buffered channel and treat notifications as hints.
+	RegisterListener(ch chan *blobref.BlobRef)
+
+	// UnregisterListener removes a channel added by
+	// RegisterListener.  It doesn't close ch.
+	UnregisterListener(ch chan *blobref.BlobRef)
+}
+
+var (
+	hubmu sync.Mutex
+	hubs  = make(map[interface{}]BlobHub)
+)
+
+// GetHub returns the BlobHub for storage, creating it on first use.
+// Receivers of blobs into storage should notify the hub; anything
+// interested in storage's new blobs should listen on it.
+func GetHub(storage interface{}) BlobHub {
+	hubmu.Lock()
+	defer hubmu.Unlock()
+	hub, ok := hubs[storage]
+	if !ok {
+		hub = new(SimpleBlobHub)
+		hubs[storage] = hub
+	}
+	return hub
+}
+
+// SimpleBlobHub is a BlobHub that sends each notification to its
+// listeners synchronously, without blocking.
+type SimpleBlobHub struct {
+	mu        sync.Mutex
+	listeners map[chan *blobref.BlobRef]bool
+}
+
+func (h *SimpleBlobHub) NotifyBlobReceived(blob *blobref.BlobRef) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.listeners {
+		select {
+		case ch <- blob:
+		default:
+		}
+	}
+}
+
+func (h *SimpleBlobHub) RegisterListener(ch chan *blobref.BlobRef) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.listeners == nil {
+		h.listeners = make(map[chan *blobref.BlobRef]bool)
+	}
+	h.listeners[ch] = true
+}
+
+func (h *SimpleBlobHub) UnregisterListener(ch chan *blobref.BlobRef) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners[ch] = false, false
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package blobserver defines the interfaces implemented by blob
+// storage backends (layer 1 of doc/overview.txt) and used by the
+// camlistored HTTP front end.
+package blobserver
+
+import (
+	"camli/blobref"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var CorruptBlobError = os.NewError("corrupt blob; digest doesn't match")
+
+// PartialWriteError is returned by ReceiveBlob of a storage that
+// writes each blob to several places, such as "replica", when the
+// blob was written to fewer of them than required.  It may still be
+// present in some.  The blob was read in full, so an upload can
+// carry on with its other blobs.
+type PartialWriteError struct {
+	Blob      *blobref.BlobRef
+	Succeeded int
+	Required  int
+	Errors    []os.Error // from the places that failed
+}
+
+func (e *PartialWriteError) String() string {
+	errs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err.String()
+	}
+	return fmt.Sprintf("blob %s written to only %d of %d required places: %s",
+		e.Blob, e.Succeeded, e.Required, strings.Join(errs, "; "))
+}
+
+type BlobReceiver interface {
+	// ReceiveBlob accepts a newly uploaded blob and writes it to
+	// permanent storage.  The bytes read from source must hash
+	// to blob, or CorruptBlobError is returned and nothing is
+	// stored.
+	ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error)
+}
+
+type BlobStatter interface {
+	// Stat checks for the existence of blobs, writing the
+	// SizedBlobRef of each one found to dest.  Missing blobs are
+	// silently skipped.  Stat must not close dest.
+	Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error
+}
+
+type BlobEnumerator interface {
+	// EnumerateBlobs sends at most limit SizedBlobRefs into dest,
+	// sorted, as long as they are lexicographically greater than
+	// after (if provided).  EnumerateBlobs must close dest when
+	// done, even on error.
+	EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error
+}
+
+type BlobRemover interface {
+	// RemoveBlobs removes the given blobs.  Removing a blob
+	// that isn't present is not an error.
+	RemoveBlobs(blobs []*blobref.BlobRef) os.Error
+}
+
+// Storage is the interface implemented by each blobserver backend.
+type Storage interface {
+	blobref.Fetcher
+	BlobReceiver
+	BlobStatter
+	BlobEnumerator
+	BlobRemover
+}
+
+// BlobModTimer is implemented by storage that can tell when each of
+// its blobs was stored.  The garbage collector uses it to spare blobs
+// too new for their referrers to have arrived yet.
+type BlobModTimer interface {
+	// BlobModTime returns when blob was stored, in nanoseconds
+	// since the epoch, or os.ENOENT if it isn't present.
+	BlobModTime(blob *blobref.BlobRef) (int64, os.Error)
+}
+
+// TempFileSweeper is implemented by storage that may be left holding
+// temporary files by writes interrupted by a crash.
+type TempFileSweeper interface {
+	// SweepTempFiles removes such files, returning how many it
+	// removed.  It must only be called when nothing else can be
+	// writing to the storage, such as when a server starts serving
+	// it; otherwise it would remove the files of writes in
+	// progress.
+	SweepTempFiles() (int, os.Error)
+}
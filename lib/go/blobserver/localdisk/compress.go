@@ -0,0 +1,172 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// Blobs that compress well are stored gzipped, in a file named like
+// the uncompressed one plus gzipSuffix.  The uncompressed size is
+// read from the gzip trailer, which is why blobs of 4GB or more are
+// never compressed.
+const gzipSuffix = ".gz"
+
+const (
+	minCompressSize = 128
+	maxCompressSize = 1<<32 - 1
+
+	// A compressed blob is only kept if it's at most this
+	// percentage of the original size.
+	maxCompressedPercent = 90
+)
+
+func (ds *diskStorage) compressedFileName(b *blobref.BlobRef) string {
+	return ds.blobFileName(b) + gzipSuffix
+}
+
+// gzipTo writes a compressed copy of the file src to a new file dst,
+// returning the compressed size.
+func gzipTo(dst, src string) (int64, os.Error) {
+	in, err := os.Open(src, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.Open(dst, os.O_WRONLY|os.O_CREAT|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	gz, err := gzip.NewWriter(out)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = io.Copy(gz, in); err != nil {
+		return 0, err
+	}
+	if err = gz.Close(); err != nil {
+		return 0, err
+	}
+	if err = out.Sync(); err != nil {
+		return 0, err
+	}
+	return out.Seek(0, 1)
+}
+
+// gzippedSize returns the uncompressed size of the gzip file
+// fileName, from the ISIZE field of its trailer.
+func gzippedSize(fileName string) (int64, os.Error) {
+	f, err := os.Open(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(-4, 2); err != nil {
+		return 0, err
+	}
+	var trailer [4]byte
+	if _, err = io.ReadFull(f, trailer[:]); err != nil {
+		return 0, err
+	}
+	return int64(trailer[0]) | int64(trailer[1])<<8 | int64(trailer[2])<<16 | int64(trailer[3])<<24, nil
+}
+
+// gzipReader is a ReadSeekCloser over the uncompressed contents of a
+// gzip file.  Seeking backwards starts decompressing again from the
+// beginning.
+type gzipReader struct {
+	file *os.File
+	gz   io.ReadCloser
+	size int64
+	off  int64
+}
+
+func openGzipped(fileName string, size int64) (*gzipReader, os.Error) {
+	file, err := os.Open(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	gr := &gzipReader{file: file, size: size}
+	if err = gr.rewind(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return gr, nil
+}
+
+func (gr *gzipReader) rewind() os.Error {
+	if gr.gz != nil {
+		gr.gz.Close()
+		gr.gz = nil
+	}
+	if _, err := gr.file.Seek(0, 0); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(gr.file)
+	if err != nil {
+		return err
+	}
+	gr.gz = gz
+	gr.off = 0
+	return nil
+}
+
+func (gr *gzipReader) Read(p []byte) (n int, err os.Error) {
+	n, err = gr.gz.Read(p)
+	gr.off += int64(n)
+	return
+}
+
+func (gr *gzipReader) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case 1:
+		offset += gr.off
+	case 2:
+		offset += gr.size
+	}
+	if offset < 0 {
+		return gr.off, os.EINVAL
+	}
+	if offset < gr.off {
+		if err := gr.rewind(); err != nil {
+			return gr.off, err
+		}
+	}
+	buf := make([]byte, 32<<10)
+	for gr.off < offset {
+		chunk := buf
+		if remain := offset - gr.off; remain < int64(len(chunk)) {
+			chunk = chunk[:remain]
+		}
+		if _, err := gr.Read(chunk); err != nil {
+			if err == os.EOF {
+				break
+			}
+			return gr.off, err
+		}
+	}
+	return gr.off, nil
+}
+
+func (gr *gzipReader) Close() os.Error {
+	gr.gz.Close()
+	return gr.file.Close()
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+type readBlobRequest struct {
+	ch      chan *blobref.SizedBlobRef
+	after   string
+	remain  *uint // limit countdown
+	dirRoot string
+
+	// unreadable, if non-nil, is told about each compressed blob
+	// whose size can't be read.  Such blobs are skipped and logged
+	// either way, rather than failing the whole enumeration.
+	unreadable func(blob *blobref.BlobRef, err os.Error)
+
+	// Not used on initial request, only on recursion
+	blobPrefix, pathInto string
+}
+
+type enumerateError struct {
+	msg string
+	err os.Error
+}
+
+func (ee *enumerateError) String() string {
+	return ee.msg + ": " + ee.err.String()
+}
+
+func (ds *diskStorage) readBlobs(opts readBlobRequest) os.Error {
+	dirFullPath := opts.dirRoot + "/" + opts.pathInto
+	dir, err := os.Open(dirFullPath, os.O_RDONLY, 0)
+	if err != nil {
+		return &enumerateError{"opening directory " + dirFullPath, err}
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(32768)
+	if err != nil {
+		return &enumerateError{"readdirnames of " + dirFullPath, err}
+	}
+	sort.SortStrings(names)
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+	}
+	for _, name := range names {
+		if *opts.remain == 0 {
+			return nil
+		}
+
+		fullPath := dirFullPath + "/" + name
+		fi, err := os.Stat(fullPath)
+		if err != nil {
+			return &enumerateError{"stat of file " + fullPath, err}
+		}
+
+		if fi.IsDirectory() {
+			var newBlobPrefix string
+			if opts.blobPrefix == "" {
+				newBlobPrefix = name + "-"
+			} else {
+				newBlobPrefix = opts.blobPrefix + name
+			}
+			if len(opts.after) > 0 {
+				compareLen := len(newBlobPrefix)
+				if len(opts.after) < compareLen {
+					compareLen = len(opts.after)
+				}
+				if newBlobPrefix[0:compareLen] < opts.after[0:compareLen] {
+					continue
+				}
+			}
+			err := ds.readBlobs(readBlobRequest{
+				ch:         opts.ch,
+				dirRoot:    opts.dirRoot,
+				after:      opts.after,
+				remain:     opts.remain,
+				blobPrefix: newBlobPrefix,
+				pathInto:   opts.pathInto + "/" + name,
+				unreadable: opts.unreadable,
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !fi.IsRegular() {
+			continue
+		}
+		compressed := strings.HasSuffix(name, ".dat"+gzipSuffix)
+		if compressed {
+			name = name[0 : len(name)-len(gzipSuffix)]
+			if present[name] {
+				// A crash while replacing one form of the
+				// blob with the other left both; the
+				// uncompressed one is what's read.
+				continue
+			}
+		}
+		if strings.HasSuffix(name, ".dat") {
+			blobName := name[0 : len(name)-4]
+			if blobName <= opts.after {
+				continue
+			}
+			blobRef := blobref.Parse(blobName)
+			if blobRef != nil {
+				size := fi.Size
+				if compressed {
+					if size, err = gzippedSize(fullPath); err != nil {
+						log.Printf("Skipping %s: reading size of compressed file: %v", fullPath, err)
+						if opts.unreadable != nil {
+							opts.unreadable(blobRef, err)
+						}
+						continue
+					}
+				}
+				opts.ch <- &blobref.SizedBlobRef{BlobRef: blobRef, Size: size}
+				(*opts.remain)--
+			}
+			continue
+		}
+	}
+
+	return nil
+}
+
+func (ds *diskStorage) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	defer close(dest)
+	limitMutable := limit
+	err := ds.readBlobs(readBlobRequest{
+		ch:      dest,
+		dirRoot: ds.root,
+		after:   after,
+		remain:  &limitMutable,
+	})
+	if err != nil {
+		log.Printf("Error enumerating blobs in %q: %v", ds.root, err)
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// FsckReport is the result of Fsck.
+type FsckReport struct {
+	Checked int
+
+	// Corrupt lists the blobs whose contents no longer match their
+	// digest, or whose compressed files are too damaged to list.
+	// Their files have been moved to the quarantine directory.
+	Corrupt []*blobref.BlobRef
+
+	// Errors describes blobs that couldn't be checked or moved.
+	Errors []string
+}
+
+// Fsck re-hashes every blob in the localdisk storage at root, moving
+// any that are corrupt into quarantineDir, which shouldn't be under
+// root.
+func Fsck(root, quarantineDir string) (*FsckReport, os.Error) {
+	s, err := New(root)
+	if err != nil {
+		return nil, err
+	}
+	ds := s.(*diskStorage)
+	if err := os.MkdirAll(quarantineDir, 0700); err != nil {
+		return nil, err
+	}
+
+	report := &FsckReport{
+		Corrupt: make([]*blobref.BlobRef, 0),
+		Errors:  make([]string, 0),
+	}
+	quarantine := func(blob *blobref.BlobRef) {
+		if err := ds.quarantine(blob, quarantineDir); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: quarantining: %v", blob, err))
+			return
+		}
+		report.Corrupt = append(report.Corrupt, blob)
+	}
+
+	// Blobs whose size can't even be read are skipped by the
+	// enumeration and dealt with afterwards.
+	unreadable := make([]*blobref.BlobRef, 0)
+	ch := make(chan *blobref.SizedBlobRef, 100)
+	errch := make(chan os.Error, 1)
+	go func() {
+		defer close(ch)
+		limit := ^uint(0)
+		errch <- ds.readBlobs(readBlobRequest{
+			ch:      ch,
+			dirRoot: ds.root,
+			remain:  &limit,
+			unreadable: func(blob *blobref.BlobRef, err os.Error) {
+				unreadable = append(unreadable, blob)
+			},
+		})
+	}()
+	for sb := range ch {
+		report.Checked++
+		ok, err := ds.blobIsIntact(sb.BlobRef)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", sb.BlobRef, err))
+			continue
+		}
+		if !ok {
+			quarantine(sb.BlobRef)
+		}
+	}
+	if err := <-errch; err != nil {
+		return nil, err
+	}
+	for _, blob := range unreadable {
+		report.Checked++
+		quarantine(blob)
+	}
+	return report, nil
+}
+
+// blobIsIntact reports whether blob's contents still match its
+// digest.  A blob that can be opened but not fully read, such as a
+// damaged compressed file, isn't intact.
+func (ds *diskStorage) blobIsIntact(blob *blobref.BlobRef) (bool, os.Error) {
+	hash := blob.Hash()
+	if hash == nil {
+		return false, os.NewError("unsupported blobref hash function")
+	}
+	file, _, err := ds.Fetch(blob)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false, nil
+	}
+	return blob.HashMatches(hash), nil
+}
+
+func (ds *diskStorage) quarantine(blob *blobref.BlobRef, quarantineDir string) os.Error {
+	for _, fileName := range []string{ds.blobFileName(blob), ds.compressedFileName(blob)} {
+		if _, err := os.Lstat(fileName); err != nil {
+			continue
+		}
+		_, base := path.Split(fileName)
+		if err := os.Rename(fileName, path.Join(quarantineDir, base)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
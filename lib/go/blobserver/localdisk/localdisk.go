@@ -0,0 +1,98 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package localdisk implements the blobserver.Storage interface on a
+// local filesystem, storing each blob in its own file under a
+// directory tree keyed by hash name and digest prefix.  Optionally,
+// blobs that compress well are stored gzipped.
+package localdisk
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"fmt"
+	"os"
+)
+
+type diskStorage struct {
+	root     string
+	compress bool
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("localdisk", newFromConfig)
+}
+
+func newFromConfig(config map[string]interface{}) (blobserver.Storage, os.Error) {
+	root, err := blobserver.ConfigString(config, "root", "")
+	if err != nil {
+		return nil, err
+	}
+	compress, err := blobserver.ConfigBool(config, "compress", false)
+	if err != nil {
+		return nil, err
+	}
+	if compress {
+		return NewCompressed(root)
+	}
+	return New(root)
+}
+
+func New(root string) (storage blobserver.Storage, err os.Error) {
+	return newDiskStorage(root, false)
+}
+
+// NewCompressed is like New, but the returned Storage gzips blobs on
+// disk when that saves space.  Either kind of Storage can read blobs
+// written by the other.
+func NewCompressed(root string) (storage blobserver.Storage, err os.Error) {
+	return newDiskStorage(root, true)
+}
+
+func newDiskStorage(root string, compress bool) (blobserver.Storage, os.Error) {
+	// Local disk.
+	fi, staterr := os.Stat(root)
+	if staterr != nil || !fi.IsDirectory() {
+		return nil, os.NewError(fmt.Sprintf("Storage root %q doesn't exist or is not a directory.", root))
+	}
+	return &diskStorage{root: root, compress: compress}, nil
+}
+
+func (ds *diskStorage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	fileName := ds.blobFileName(blob)
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return ds.fetchCompressed(blob)
+	}
+	file, err := os.Open(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, stat.Size, nil
+}
+
+func (ds *diskStorage) fetchCompressed(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	fileName := ds.compressedFileName(blob)
+	size, err := gzippedSize(fileName)
+	if err != nil {
+		return nil, 0, os.ENOENT
+	}
+	file, err := openGzipped(fileName, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return file, size, nil
+}
@@ -0,0 +1,447 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func refOf(s string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(s))
+	return blobref.FromHash("sha1", s1)
+}
+
+func newTestStorage(t *testing.T, compress bool) (*diskStorage, func()) {
+	root, err := ioutil.TempDir("", "camli-localdisk-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	s, err := newDiskStorage(root, compress)
+	if err != nil {
+		t.Fatalf("newDiskStorage: %v", err)
+	}
+	return s.(*diskStorage), func() { os.RemoveAll(root) }
+}
+
+func TestCompression(t *testing.T) {
+	ds, cleanup := newTestStorage(t, true)
+	defer cleanup()
+
+	text := strings.Repeat("all work and no play makes jack a dull boy\n", 100)
+	random := make([]byte, 4096)
+	f, err := os.Open("/dev/urandom", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("opening /dev/urandom: %v", err)
+	}
+	f.Read(random)
+	f.Close()
+
+	blobs := []struct {
+		contents   string
+		compressed bool
+	}{
+		{text, true},
+		{string(random), false},
+		{"tiny", false},
+	}
+	for _, b := range blobs {
+		blob := refOf(b.contents)
+		sb, err := ds.ReceiveBlob(blob, strings.NewReader(b.contents))
+		if err != nil {
+			t.Fatalf("ReceiveBlob: %v", err)
+		}
+		if sb.Size != int64(len(b.contents)) {
+			t.Errorf("ReceiveBlob size = %d; want %d", sb.Size, len(b.contents))
+		}
+		_, err = os.Stat(ds.compressedFileName(blob))
+		if compressed := err == nil; compressed != b.compressed {
+			t.Errorf("blob of %d bytes compressed = %v; want %v", len(b.contents), compressed, b.compressed)
+		}
+
+		r, size, err := ds.Fetch(blob)
+		if err != nil {
+			t.Fatalf("Fetch: %v", err)
+		}
+		if size != int64(len(b.contents)) {
+			t.Errorf("Fetch size = %d; want %d", size, len(b.contents))
+		}
+		got, _ := ioutil.ReadAll(r)
+		if string(got) != b.contents {
+			t.Errorf("Fetch of %d byte blob returned wrong contents", len(b.contents))
+		}
+		r.Close()
+	}
+
+	// Seeking forwards and backwards in a compressed blob.
+	r, _, _ := ds.Fetch(refOf(text))
+	defer r.Close()
+	buf := make([]byte, 4)
+	for _, off := range []int64{1000, 44, 2000} {
+		if pos, err := r.Seek(off, 0); pos != off || err != nil {
+			t.Fatalf("Seek(%d) = %d, %v", off, pos, err)
+		}
+		r.Read(buf)
+		if string(buf) != text[off:off+4] {
+			t.Errorf("read at %d = %q; want %q", off, buf, text[off:off+4])
+		}
+	}
+	if pos, _ := r.Seek(0, 2); pos != int64(len(text)) {
+		t.Errorf("Seek to end = %d; want %d", pos, len(text))
+	}
+
+	statch := make(chan *blobref.SizedBlobRef, 10)
+	ds.Stat(statch, []*blobref.BlobRef{refOf(text)})
+	close(statch)
+	for sb := range statch {
+		if sb.Size != int64(len(text)) {
+			t.Errorf("Stat size = %d; want %d", sb.Size, len(text))
+		}
+	}
+
+	ch := make(chan *blobref.SizedBlobRef)
+	go ds.EnumerateBlobs(ch, "", 10)
+	n := 0
+	for sb := range ch {
+		n++
+		if sb.BlobRef.String() == refOf(text).String() && sb.Size != int64(len(text)) {
+			t.Errorf("enumerate size = %d; want %d", sb.Size, len(text))
+		}
+	}
+	if n != len(blobs) {
+		t.Errorf("enumerated %d blobs; want %d", n, len(blobs))
+	}
+
+	// An uncompressed storage can still read it, and removing it
+	// removes the compressed file.
+	plain := &diskStorage{root: ds.root}
+	if _, size, err := plain.Fetch(refOf(text)); err != nil || size != int64(len(text)) {
+		t.Errorf("uncompressed storage Fetch = %d, %v", size, err)
+	}
+	if err := plain.RemoveBlobs([]*blobref.BlobRef{refOf(text)}); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if _, _, err := ds.Fetch(refOf(text)); err != os.ENOENT {
+		t.Errorf("Fetch after remove = %v; want ENOENT", err)
+	}
+}
+
+func TestDuplicateForms(t *testing.T) {
+	ds, cleanup := newTestStorage(t, true)
+	defer cleanup()
+
+	// As if a crash came between storing the compressed file and
+	// removing the uncompressed one.
+	text := strings.Repeat("stored twice; ", 100)
+	blob := refOf(text)
+	if _, err := ds.ReceiveBlob(blob, strings.NewReader(text)); err != nil {
+		t.Fatalf("ReceiveBlob: %v", err)
+	}
+	if err := ioutil.WriteFile(ds.blobFileName(blob), []byte(text), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	ch := make(chan *blobref.SizedBlobRef)
+	go ds.EnumerateBlobs(ch, "", 10)
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	if n != 1 {
+		t.Errorf("enumerated %d blobs; want 1", n)
+	}
+
+	if n, err := ds.SweepTempFiles(); n != 1 || err != nil {
+		t.Errorf("SweepTempFiles = %d, %v; want 1", n, err)
+	}
+	if _, err := os.Stat(ds.compressedFileName(blob)); err == nil {
+		t.Errorf("duplicate compressed file wasn't swept")
+	}
+	if _, _, err := ds.Fetch(blob); err != nil {
+		t.Errorf("Fetch after sweep: %v", err)
+	}
+}
+
+func TestCorruptBlobNotStored(t *testing.T) {
+	ds, cleanup := newTestStorage(t, false)
+	defer cleanup()
+	foo := refOf("foo")
+	if _, err := ds.ReceiveBlob(foo, strings.NewReader("bar")); err != blobserver.CorruptBlobError {
+		t.Errorf("expected CorruptBlobError; got %v", err)
+	}
+	if _, _, err := ds.Fetch(foo); err != os.ENOENT {
+		t.Errorf("Fetch of corrupt blob = %v; want ENOENT", err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	ds, cleanup := newTestStorage(t, true)
+	defer cleanup()
+	quarantineDir := ds.root + "-quarantine"
+	defer os.RemoveAll(quarantineDir)
+
+	text := strings.Repeat("compressible text; ", 50)
+	truncated := strings.Repeat("truncated text; ", 50)
+	for _, contents := range []string{"good", "rotten", text, truncated} {
+		if _, err := ds.ReceiveBlob(refOf(contents), strings.NewReader(contents)); err != nil {
+			t.Fatalf("ReceiveBlob: %v", err)
+		}
+	}
+	// Flip some bits on disk in a plain and a compressed blob.
+	if err := ioutil.WriteFile(ds.blobFileName(refOf("rotten")), []byte("rotteN"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	gzName := ds.compressedFileName(refOf(text))
+	gz, err := ioutil.ReadFile(gzName)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	gz[len(gz)/2] ^= 0xff
+	ioutil.WriteFile(gzName, gz, 0600)
+	// And cut one short enough that its size trailer is gone.
+	ioutil.WriteFile(ds.compressedFileName(refOf(truncated)), []byte{0x1f, 0x8b}, 0600)
+
+	ch := make(chan *blobref.SizedBlobRef)
+	go ds.EnumerateBlobs(ch, "", 10)
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("enumerated %d blobs; want 3, skipping the truncated one", n)
+	}
+
+	report, err := Fsck(ds.root, quarantineDir)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	if report.Checked != 4 || len(report.Corrupt) != 3 || len(report.Errors) != 0 {
+		t.Errorf("report = %+v; want 4 checked, 3 corrupt", report)
+	}
+	if _, _, err := ds.Fetch(refOf("rotten")); err != os.ENOENT {
+		t.Errorf("corrupt blob still fetchable: %v", err)
+	}
+	if _, _, err := ds.Fetch(refOf("good")); err != nil {
+		t.Errorf("good blob was quarantined: %v", err)
+	}
+	names, _ := ioutil.ReadDir(quarantineDir)
+	if len(names) != 3 {
+		t.Errorf("quarantine has %d files; want 3", len(names))
+	}
+}
+
+// failingReader returns part of a blob, then fails, as a dropped
+// client connection would.
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, os.Error) {
+	if r.data == "" {
+		return 0, os.NewError("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func assertInvisible(t *testing.T, ds *diskStorage, blob *blobref.BlobRef) {
+	if _, _, err := ds.Fetch(blob); err != os.ENOENT {
+		t.Errorf("Fetch of partial blob = %v; want ENOENT", err)
+	}
+	ch := make(chan *blobref.SizedBlobRef)
+	go ds.EnumerateBlobs(ch, "", 100)
+	for sb := range ch {
+		if sb.BlobRef.String() == blob.String() {
+			t.Errorf("partial blob %s enumerated", blob)
+		}
+	}
+}
+
+func TestInterruptedUpload(t *testing.T) {
+	ds, cleanup := newTestStorage(t, false)
+	defer cleanup()
+
+	contents := strings.Repeat("x", 10000)
+	blob := refOf(contents)
+	if _, err := ds.ReceiveBlob(blob, &failingReader{contents[:5000]}); err == nil {
+		t.Fatalf("expected error from interrupted upload")
+	}
+	assertInvisible(t, ds, blob)
+	if n, _ := sweepTempFiles(ds.root); n != 0 {
+		t.Errorf("failed upload left %d temp files", n)
+	}
+
+	// A crash between creating the temp file and renaming it into
+	// place leaves the temp file behind.
+	if err := os.MkdirAll(ds.blobDirectoryName(blob), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	tempName := ds.blobFileName(blob) + tempFileMarker + "12345"
+	if err := ioutil.WriteFile(tempName, []byte(contents[:5000]), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	assertInvisible(t, ds, blob)
+
+	// Merely opening the storage, as fsck and gc do while a server
+	// may be writing to it, leaves it alone.
+	s, err := New(ds.root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := os.Stat(tempName); err != nil {
+		t.Errorf("temp file %s removed by New: %v", tempName, err)
+	}
+
+	// Sweeping at server startup removes it.
+	if n, err := s.(blobserver.TempFileSweeper).SweepTempFiles(); n != 1 || err != nil {
+		t.Errorf("SweepTempFiles = %d, %v; want 1", n, err)
+	}
+	if _, err := os.Stat(tempName); err == nil {
+		t.Errorf("stale temp file %s not swept", tempName)
+	}
+	assertInvisible(t, s.(*diskStorage), blob)
+
+	if _, err := s.ReceiveBlob(blob, strings.NewReader(contents)); err != nil {
+		t.Fatalf("ReceiveBlob after restart: %v", err)
+	}
+	if _, size, err := s.Fetch(blob); err != nil || size != int64(len(contents)) {
+		t.Errorf("Fetch after retried upload = %d, %v", size, err)
+	}
+}
+
+func TestHashFunctions(t *testing.T) {
+	ds, cleanup := newTestStorage(t, false)
+	defer cleanup()
+
+	var blobs []*blobref.BlobRef
+	for _, hashName := range []string{"sha256", "sha1", "sha224"} {
+		hash := blobref.NewHash(hashName)
+		hash.Write([]byte("foo"))
+		blob := blobref.FromHash(hashName, hash)
+		if _, err := ds.ReceiveBlob(blob, strings.NewReader("foo")); err != nil {
+			t.Fatalf("ReceiveBlob(%s): %v", blob, err)
+		}
+		if _, err := ds.ReceiveBlob(blob, strings.NewReader("bar")); err != blobserver.CorruptBlobError {
+			t.Errorf("ReceiveBlob(%s) of wrong contents = %v; want CorruptBlobError", blob, err)
+		}
+		if _, err := os.Stat(ds.blobFileName(blob)); err != nil {
+			t.Errorf("%s not stored under its own hash directory: %v", blob, err)
+		}
+		blobs = append(blobs, blob)
+	}
+
+	ch := make(chan *blobref.SizedBlobRef)
+	go ds.EnumerateBlobs(ch, "", 10)
+	var got []string
+	for sb := range ch {
+		got = append(got, sb.BlobRef.String())
+	}
+	want := []string{blobs[1].String(), blobs[2].String(), blobs[0].String()}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("enumerated %v; want %v", got, want)
+	}
+
+	ch = make(chan *blobref.SizedBlobRef)
+	go ds.EnumerateBlobs(ch, blobs[1].String(), 10)
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("enumerated %d blobs after the sha1 blob; want 2", n)
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	ds, cleanup := newTestStorage(t, false)
+	defer cleanup()
+
+	contents := strings.Repeat("abcdefghij", 1000)
+	blob := refOf(contents)
+	checkPartial := func(size int) *blobserver.PartialUpload {
+		partials, err := ds.PartialUploads(blob)
+		if err != nil {
+			t.Fatalf("PartialUploads: %v", err)
+		}
+		if len(partials) != 1 {
+			t.Fatalf("got %d partial uploads; want 1", len(partials))
+		}
+		p := partials[0]
+		if p.Size != int64(size) || p.PartBlobRef.String() != refOf(contents[:size]).String() {
+			t.Errorf("partial upload = %d bytes, %s; want %d bytes, %s",
+				p.Size, p.PartBlobRef, size, refOf(contents[:size]))
+		}
+		if got := blobserver.ParseResumeKey(p.ResumeKey()); got == nil || got.ResumeKey() != p.ResumeKey() {
+			t.Errorf("resume key %q doesn't round-trip", p.ResumeKey())
+		}
+		return p
+	}
+
+	if _, err := ds.ReceiveBlob(blob, &failingReader{contents[:5000]}); err == nil {
+		t.Fatalf("expected error from interrupted upload")
+	}
+	assertInvisible(t, ds, blob)
+	p := checkPartial(5000)
+
+	if _, err := ds.ResumeBlob(p, &failingReader{contents[5000:7000]}); err == nil {
+		t.Fatalf("expected error from interrupted resumed upload")
+	}
+	p = checkPartial(7000)
+
+	sb, err := ds.ResumeBlob(p, strings.NewReader(contents[7000:]))
+	if err != nil {
+		t.Fatalf("ResumeBlob: %v", err)
+	}
+	if sb.Size != int64(len(contents)) {
+		t.Errorf("ResumeBlob size = %d; want %d", sb.Size, len(contents))
+	}
+	if partials, _ := ds.PartialUploads(blob); len(partials) != 0 {
+		t.Errorf("partial uploads left after resume: %v", partials)
+	}
+	r, _, err := ds.Fetch(blob)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(got) != contents {
+		t.Errorf("resumed blob has wrong contents")
+	}
+
+	// A corrupt upload isn't kept.
+	other := refOf("other")
+	if _, err := ds.ReceiveBlob(other, strings.NewReader("bogus")); err != blobserver.CorruptBlobError {
+		t.Errorf("ReceiveBlob of wrong contents = %v; want CorruptBlobError", err)
+	}
+	if partials, _ := ds.PartialUploads(other); len(partials) != 0 {
+		t.Errorf("corrupt upload kept as partial upload: %v", partials)
+	}
+	ds.ReceiveBlob(other, &failingReader{"oth"})
+	if err := ds.RemovePartialUploads(other); err != nil {
+		t.Fatalf("RemovePartialUploads: %v", err)
+	}
+	if partials, _ := ds.PartialUploads(other); len(partials) != 0 {
+		t.Errorf("partial uploads left after RemovePartialUploads: %v", partials)
+	}
+}
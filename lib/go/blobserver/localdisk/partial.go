@@ -0,0 +1,118 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// partialSuffix ends the names of files holding partial uploads,
+// which are kept next to where the finished blob would go.
+const partialSuffix = ".partial"
+
+// partialMaxAge is how long, in nanoseconds, a partial upload is kept
+// before it's swept at startup.
+const partialMaxAge = 24 * 60 * 60 * 1e9
+
+func (ds *diskStorage) partialFileName(p *blobserver.PartialUpload) string {
+	return ds.blobDirectoryName(p.BlobRef) + "/" + p.ResumeKey() + partialSuffix
+}
+
+// keepPartial keeps the first written bytes of an upload of blob,
+// already in tempFile and hashed by hash, as a partial upload.  It
+// returns the partial upload's file name, or "" if it couldn't be
+// kept.
+func (ds *diskStorage) keepPartial(blob *blobref.BlobRef, tempFile *os.File, written int64, hash hash.Hash) string {
+	partial := &blobserver.PartialUpload{
+		BlobRef:     blob,
+		Size:        written,
+		PartBlobRef: blobref.FromHash(blob.HashName(), hash),
+	}
+	fileName := ds.partialFileName(partial)
+	err := tempFile.Sync()
+	if err == nil {
+		err = tempFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), fileName)
+	}
+	if err != nil {
+		log.Printf("Not keeping partial upload of %s: %v", blob, err)
+		return ""
+	}
+	log.Printf("Keeping %d bytes of interrupted upload of %s", written, blob)
+	return fileName
+}
+
+func (ds *diskStorage) PartialUploads(blob *blobref.BlobRef) ([]*blobserver.PartialUpload, os.Error) {
+	dir, err := os.Open(ds.blobDirectoryName(blob), os.O_RDONLY, 0)
+	if err != nil {
+		// No directory, so no partial uploads.
+		return nil, nil
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	var partials []*blobserver.PartialUpload
+	prefix := "resume-" + blob.String() + "-"
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, partialSuffix) {
+			continue
+		}
+		p := blobserver.ParseResumeKey(name[:len(name)-len(partialSuffix)])
+		if p != nil && p.BlobRef.String() == blob.String() {
+			partials = append(partials, p)
+		}
+	}
+	return partials, nil
+}
+
+func (ds *diskStorage) ResumeBlob(partial *blobserver.PartialUpload, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	fileName := ds.partialFileName(partial)
+	file, err := os.Open(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	blobGot, kept, err := ds.receiveBlob(partial.BlobRef,
+		io.MultiReader(io.LimitReader(file, partial.Size), source))
+	if kept != fileName {
+		os.Remove(fileName)
+	}
+	return blobGot, err
+}
+
+func (ds *diskStorage) RemovePartialUploads(blob *blobref.BlobRef) os.Error {
+	partials, err := ds.PartialUploads(blob)
+	if err != nil {
+		return err
+	}
+	for _, p := range partials {
+		if err := os.Remove(ds.partialFileName(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"exec"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var flagOpenImages *bool = flag.Bool("showimages", false, "Show images on receiving them with eog.")
+
+func (ds *diskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	blobGot, _, err := ds.receiveBlob(blobRef, source)
+	return blobGot, err
+}
+
+// sourceReader records the error, if any, from reading an upload's
+// source, so it can be told apart from errors writing the blob.
+type sourceReader struct {
+	r   io.Reader
+	err os.Error
+}
+
+func (sr *sourceReader) Read(p []byte) (n int, err os.Error) {
+	n, err = sr.r.Read(p)
+	if err != nil && err != os.EOF {
+		sr.err = err
+	}
+	return
+}
+
+// receiveBlob receives a blob like ReceiveBlob.  If reading source
+// fails, what was read of it is kept as a partial upload, whose file
+// name is returned.
+func (ds *diskStorage) receiveBlob(blobRef *blobref.BlobRef, source io.Reader) (blobGot *blobref.SizedBlobRef, partialName string, err os.Error) {
+	hashedDirectory := ds.blobDirectoryName(blobRef)
+	_, statErr := os.Stat(hashedDirectory)
+	createdDirs := statErr != nil
+	err = os.MkdirAll(hashedDirectory, 0700)
+	if err != nil {
+		return
+	}
+
+	var tempFile *os.File
+	tempFile, err = ioutil.TempFile(hashedDirectory, blobFileBaseName(blobRef)+tempFileMarker)
+	if err != nil {
+		return
+	}
+
+	success := false // set true later
+	defer func() {
+		if !success {
+			log.Println("Removing temp file: ", tempFile.Name())
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+		}
+	}()
+
+	hash := blobRef.Hash()
+	var written int64
+	sr := &sourceReader{r: source}
+	written, err = io.Copy(io.MultiWriter(hash, tempFile), sr)
+	if err != nil {
+		if err == sr.err && written > 0 {
+			partialName = ds.keepPartial(blobRef, tempFile, written, hash)
+			success = partialName != ""
+		}
+		return
+	}
+	// The blob must be on disk before it's visible under its final
+	// name, or a crash could leave a truncated blob behind.
+	if err = tempFile.Sync(); err != nil {
+		return
+	}
+	if err = tempFile.Close(); err != nil {
+		return
+	}
+
+	if !blobRef.HashMatches(hash) {
+		err = blobserver.CorruptBlobError
+		return
+	}
+
+	if ds.compress && written >= minCompressSize && written <= maxCompressSize {
+		var stored bool
+		stored, err = ds.storeCompressed(blobRef, tempFile.Name(), written)
+		if err != nil {
+			return
+		}
+		if stored {
+			os.Remove(tempFile.Name())
+			if err = ds.syncBlobDirs(blobRef, createdDirs); err != nil {
+				return
+			}
+			blobGot = &blobref.SizedBlobRef{BlobRef: blobRef, Size: written}
+			success = true
+			return
+		}
+	}
+
+	fileName := ds.blobFileName(blobRef)
+	if err = os.Rename(tempFile.Name(), fileName); err != nil {
+		return
+	}
+	// Don't leave a stale compressed copy behind.
+	os.Remove(ds.compressedFileName(blobRef))
+	if err = ds.syncBlobDirs(blobRef, createdDirs); err != nil {
+		return
+	}
+
+	stat, err := os.Lstat(fileName)
+	if err != nil {
+		return
+	}
+	if !stat.IsRegular() || stat.Size != written {
+		err = os.NewError("Written size didn't match.")
+		return
+	}
+
+	blobGot = &blobref.SizedBlobRef{BlobRef: blobRef, Size: stat.Size}
+	success = true
+
+	if *flagOpenImages {
+		exec.Run("/usr/bin/eog",
+			[]string{"/usr/bin/eog", fileName},
+			os.Environ(),
+			"/",
+			exec.DevNull,
+			exec.DevNull,
+			exec.MergeWithStdout)
+	}
+
+	return
+}
+
+// storeCompressed stores a gzipped copy of the verified blob in
+// tempName if that's sufficiently smaller than its size, written.  It
+// reports whether it did.
+func (ds *diskStorage) storeCompressed(blobRef *blobref.BlobRef, tempName string, written int64) (stored bool, err os.Error) {
+	gzTemp := tempName + gzipSuffix
+	defer os.Remove(gzTemp)
+	compressedSize, err := gzipTo(gzTemp, tempName)
+	if err != nil {
+		return false, err
+	}
+	if compressedSize*100 > written*maxCompressedPercent {
+		return false, nil
+	}
+	fileName := ds.compressedFileName(blobRef)
+	if err = os.Rename(gzTemp, fileName); err != nil {
+		return false, err
+	}
+	os.Remove(ds.blobFileName(blobRef))
+
+	size, err := gzippedSize(fileName)
+	if err != nil {
+		return false, err
+	}
+	if size != written {
+		return false, os.NewError("Written size didn't match.")
+	}
+	return true, nil
+}
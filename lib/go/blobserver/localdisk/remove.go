@@ -0,0 +1,39 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"os"
+)
+
+func (ds *diskStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	for _, blob := range blobs {
+		for _, fileName := range []string{ds.blobFileName(blob), ds.compressedFileName(blob)} {
+			err := os.Remove(fileName)
+			switch {
+			case err == nil:
+				continue
+			case err.(*os.PathError).Error == os.ENOENT:
+				continue
+			default:
+				return err
+			}
+		}
+	}
+	return nil
+}
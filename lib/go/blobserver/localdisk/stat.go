@@ -0,0 +1,78 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"os"
+)
+
+// maxParallelStats bounds how many blob files Stat examines at once.
+const maxParallelStats = 20
+
+func (ds *diskStorage) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	workers := maxParallelStats
+	if len(blobs) < workers {
+		workers = len(blobs)
+	}
+	refChan := make(chan *blobref.BlobRef)
+	resultChan := make(chan *blobref.SizedBlobRef)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for ref := range refChan {
+				resultChan <- ds.statBlob(ref)
+			}
+		}()
+	}
+	go func() {
+		for _, ref := range blobs {
+			refChan <- ref
+		}
+		close(refChan)
+	}()
+
+	for _ = range blobs {
+		if sb := <-resultChan; sb != nil {
+			dest <- sb
+		}
+	}
+	return nil
+}
+
+// statBlob returns the size of blob, or nil if it's not present.
+func (ds *diskStorage) statBlob(ref *blobref.BlobRef) *blobref.SizedBlobRef {
+	fi, err := os.Stat(ds.blobFileName(ref))
+	if err == nil && fi.IsRegular() {
+		return &blobref.SizedBlobRef{BlobRef: ref, Size: fi.Size}
+	}
+	if size, err := gzippedSize(ds.compressedFileName(ref)); err == nil {
+		return &blobref.SizedBlobRef{BlobRef: ref, Size: size}
+	}
+	return nil
+}
+
+// BlobModTime returns the modification time of blob's file.
+func (ds *diskStorage) BlobModTime(ref *blobref.BlobRef) (int64, os.Error) {
+	fi, err := os.Stat(ds.blobFileName(ref))
+	if err != nil {
+		fi, err = os.Stat(ds.compressedFileName(ref))
+	}
+	if err != nil {
+		return 0, os.ENOENT
+	}
+	return fi.Mtime_ns, nil
+}
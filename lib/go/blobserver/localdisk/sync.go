@@ -0,0 +1,117 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"camli/blobref"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// tempFileMarker appears in the names of the temporary files blobs are
+// written to before being renamed into place.
+const tempFileMarker = ".tmp"
+
+func syncDir(dir string) os.Error {
+	d, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// syncBlobDirs makes a blob's directory entry durable.  If
+// createdDirs, its directory was just created, so the directories
+// above it up to the root are synced too.
+func (ds *diskStorage) syncBlobDirs(b *blobref.BlobRef, createdDirs bool) os.Error {
+	leaf := ds.blobDirectoryName(b)
+	if !createdDirs {
+		return syncDir(leaf)
+	}
+	hashDir := ds.root + "/" + b.HashName()
+	for _, dir := range []string{leaf, hashDir + "/" + b.Digest()[0:3], hashDir, ds.root} {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SweepTempFiles implements blobserver.TempFileSweeper.
+func (ds *diskStorage) SweepTempFiles() (int, os.Error) {
+	return sweepTempFiles(ds.root)
+}
+
+// sweepTempFiles removes temporary files left under dir by uploads
+// that were interrupted by a crash, compressed copies of blobs that a
+// crash left stored uncompressed as well, and partial uploads older
+// than partialMaxAge.  It returns how many files it removed.
+func sweepTempFiles(dir string) (int, os.Error) {
+	d, err := os.Open(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return 0, err
+	}
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+	}
+	removed := 0
+	for _, name := range names {
+		fullPath := dir + "/" + name
+		fi, err := os.Lstat(fullPath)
+		if err != nil {
+			return removed, err
+		}
+		switch {
+		case fi.IsDirectory():
+			n, err := sweepTempFiles(fullPath)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		case fi.IsRegular() && strings.Contains(name, tempFileMarker):
+			log.Printf("Removing stale temp file %s", fullPath)
+			if err := os.Remove(fullPath); err != nil {
+				return removed, err
+			}
+			removed++
+		case fi.IsRegular() && strings.HasSuffix(name, ".dat"+gzipSuffix) &&
+			present[name[:len(name)-len(gzipSuffix)]]:
+			log.Printf("Removing duplicate compressed blob %s", fullPath)
+			if err := os.Remove(fullPath); err != nil {
+				return removed, err
+			}
+			removed++
+		case fi.IsRegular() && strings.HasSuffix(name, partialSuffix) &&
+			time.Nanoseconds()-fi.Mtime_ns > partialMaxAge:
+			log.Printf("Removing old partial upload %s", fullPath)
+			if err := os.Remove(fullPath); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package memory implements a blobserver.Storage that keeps all blobs
+// in memory.  It's meant for tests and ephemeral servers; everything
+// is lost when the process exits.
+package memory
+
+import (
+	"bytes"
+	"camli/blobref"
+	"camli/blobserver"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryStorage struct {
+	mu     sync.RWMutex
+	blobs  map[string][]byte // blobref string -> contents
+	mtimes map[string]int64  // blobref string -> when stored, in ns
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("memory", newFromConfig)
+}
+
+func newFromConfig(config map[string]interface{}) (blobserver.Storage, os.Error) {
+	return New(), nil
+}
+
+func New() blobserver.Storage {
+	return &memoryStorage{blobs: make(map[string][]byte), mtimes: make(map[string]int64)}
+}
+
+type byteReaderAt []byte
+
+func (b byteReaderAt) ReadAt(p []byte, off int64) (n int, err os.Error) {
+	if off >= int64(len(b)) {
+		return 0, os.EOF
+	}
+	n = copy(p, b[off:])
+	if n < len(p) {
+		err = os.EOF
+	}
+	return
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (sectionReadCloser) Close() os.Error {
+	return nil
+}
+
+func (ms *memoryStorage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	ms.mu.RLock()
+	b, ok := ms.blobs[blob.String()]
+	ms.mu.RUnlock()
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	size := int64(len(b))
+	return sectionReadCloser{io.NewSectionReader(byteReaderAt(b), 0, size)}, size, nil
+}
+
+func (ms *memoryStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	hash := blob.Hash()
+	if hash == nil {
+		return nil, os.NewError("unsupported blobref hash function")
+	}
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(io.MultiWriter(hash, buf), source); err != nil {
+		return nil, err
+	}
+	if !blob.HashMatches(hash) {
+		return nil, blobserver.CorruptBlobError
+	}
+	ms.mu.Lock()
+	ms.blobs[blob.String()] = buf.Bytes()
+	ms.mtimes[blob.String()] = time.Nanoseconds()
+	ms.mu.Unlock()
+	return &blobref.SizedBlobRef{BlobRef: blob, Size: int64(buf.Len())}, nil
+}
+
+func (ms *memoryStorage) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	found := make([]*blobref.SizedBlobRef, 0, len(blobs))
+	ms.mu.RLock()
+	for _, blob := range blobs {
+		if b, ok := ms.blobs[blob.String()]; ok {
+			found = append(found, &blobref.SizedBlobRef{BlobRef: blob, Size: int64(len(b))})
+		}
+	}
+	ms.mu.RUnlock()
+	for _, sb := range found {
+		dest <- sb
+	}
+	return nil
+}
+
+func (ms *memoryStorage) BlobModTime(blob *blobref.BlobRef) (int64, os.Error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	mtime, ok := ms.mtimes[blob.String()]
+	if !ok {
+		return 0, os.ENOENT
+	}
+	return mtime, nil
+}
+
+func (ms *memoryStorage) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	defer close(dest)
+	ms.mu.RLock()
+	keys := make([]string, 0, len(ms.blobs))
+	for key, _ := range ms.blobs {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.SortStrings(keys)
+	if uint(len(keys)) > limit {
+		keys = keys[:limit]
+	}
+	found := make([]*blobref.SizedBlobRef, 0, len(keys))
+	for _, key := range keys {
+		if br := blobref.Parse(key); br != nil {
+			found = append(found, &blobref.SizedBlobRef{BlobRef: br, Size: int64(len(ms.blobs[key]))})
+		}
+	}
+	ms.mu.RUnlock()
+	for _, sb := range found {
+		dest <- sb
+	}
+	return nil
+}
+
+func (ms *memoryStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for _, blob := range blobs {
+		ms.blobs[blob.String()] = nil, false
+		ms.mtimes[blob.String()] = 0, false
+	}
+	return nil
+}
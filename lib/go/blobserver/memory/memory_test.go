@@ -0,0 +1,85 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func refOf(s string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(s))
+	return blobref.FromHash("sha1", s1)
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := New()
+	foo := refOf("foo")
+	if _, err := s.ReceiveBlob(foo, strings.NewReader("not foo")); err != blobserver.CorruptBlobError {
+		t.Errorf("expected CorruptBlobError; got %v", err)
+	}
+	if _, _, err := s.Fetch(foo); err != os.ENOENT {
+		t.Errorf("expected ENOENT for corrupt blob; got %v", err)
+	}
+
+	for _, contents := range []string{"foo", "bar", "baz"} {
+		if _, err := s.ReceiveBlob(refOf(contents), strings.NewReader(contents)); err != nil {
+			t.Fatalf("ReceiveBlob(%q): %v", contents, err)
+		}
+	}
+
+	r, size, err := s.Fetch(foo)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	r.Seek(1, 0)
+	rest, _ := ioutil.ReadAll(r)
+	if size != 3 || string(rest) != "oo" {
+		t.Errorf("Fetch after seek = %d, %q", size, rest)
+	}
+
+	ch := make(chan *blobref.SizedBlobRef, 10)
+	s.EnumerateBlobs(ch, "", 2)
+	got := make([]string, 0)
+	for sb := range ch {
+		got = append(got, sb.BlobRef.String())
+	}
+	if len(got) != 2 || got[0] >= got[1] {
+		t.Errorf("enumerate with limit 2 = %q", got)
+	}
+
+	s.RemoveBlobs([]*blobref.BlobRef{foo})
+	statch := make(chan *blobref.SizedBlobRef, 10)
+	s.Stat(statch, []*blobref.BlobRef{foo, refOf("bar")})
+	close(statch)
+	n := 0
+	for sb := range statch {
+		if sb.BlobRef.String() != refOf("bar").String() {
+			t.Errorf("unexpected stat result %v", sb)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Errorf("expected 1 stat result; got %d", n)
+	}
+}
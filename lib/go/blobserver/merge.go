@@ -0,0 +1,135 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"camli/blobref"
+	"fmt"
+	"os"
+)
+
+// enumerateAllPageSize is how many blobs EnumerateAll asks for at a
+// time.
+const enumerateAllPageSize = 1000
+
+// EnumerateAll calls fn with every blob in storage, in order, asking
+// for them a page at a time.
+func EnumerateAll(storage BlobEnumerator, fn func(*blobref.SizedBlobRef)) os.Error {
+	after := ""
+	for {
+		ch := make(chan *blobref.SizedBlobRef, 100)
+		errch := make(chan os.Error, 1)
+		go func(after string) {
+			errch <- storage.EnumerateBlobs(ch, after, enumerateAllPageSize)
+		}(after)
+		n := 0
+		for sb := range ch {
+			fn(sb)
+			after = sb.BlobRef.String()
+			n++
+		}
+		if err := <-errch; err != nil {
+			return err
+		}
+		if n < enumerateAllPageSize {
+			return nil
+		}
+	}
+	panic("unreachable")
+}
+
+// MergedEnumerate enumerates the blobs of several sources as one
+// sorted stream, sending each blobref at most once even if more than
+// one source has it.  Like EnumerateBlobs, it closes dest.
+func MergedEnumerate(dest chan *blobref.SizedBlobRef, sources []BlobEnumerator, after string, limit uint) os.Error {
+	defer close(dest)
+	n := len(sources)
+	chans := make([]chan *blobref.SizedBlobRef, n)
+	errch := make(chan os.Error, n)
+	for i, src := range sources {
+		ch := make(chan *blobref.SizedBlobRef, 100)
+		chans[i] = ch
+		go func(src BlobEnumerator) {
+			errch <- src.EnumerateBlobs(ch, after, limit)
+		}(src)
+	}
+
+	// heads[i] is the next unsent blob from source i, or nil once
+	// that source is exhausted.
+	heads := make([]*blobref.SizedBlobRef, n)
+	for i, ch := range chans {
+		heads[i] = <-ch
+	}
+	last := ""
+	for sent := uint(0); sent < limit; {
+		min := -1
+		for i, sb := range heads {
+			if sb != nil && (min == -1 || sb.BlobRef.String() < heads[min].BlobRef.String()) {
+				min = i
+			}
+		}
+		if min == -1 {
+			break
+		}
+		sb := heads[min]
+		heads[min] = <-chans[min]
+		if key := sb.BlobRef.String(); key != last {
+			dest <- sb
+			last = key
+			sent++
+		}
+	}
+
+	for _, ch := range chans {
+		for _ = range ch {
+		}
+	}
+	var firstErr os.Error
+	for i := 0; i < n; i++ {
+		if err := <-errch; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// NewestModTime returns the latest time any of storages reports for
+// blob, for storage that spreads its blobs over several others.  It
+// returns os.ENOENT if none of them has blob.
+func NewestModTime(storages []Storage, blob *blobref.BlobRef) (int64, os.Error) {
+	newest, found := int64(0), false
+	for _, s := range storages {
+		mt, ok := s.(BlobModTimer)
+		if !ok {
+			return 0, os.NewError(fmt.Sprintf("%T can't tell when blobs were stored", s))
+		}
+		mtime, err := mt.BlobModTime(blob)
+		if err == os.ENOENT {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !found || mtime > newest {
+			newest, found = mtime, true
+		}
+	}
+	if !found {
+		return 0, os.ENOENT
+	}
+	return newest, nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packed
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// openIndex loads the index file into memory, discarding any torn
+// final record, and opens the newest pack for appending.
+func (ps *packStorage) openIndex() os.Error {
+	indexName := ps.root + "/index"
+	f, err := os.Open(indexName, os.O_RDWR|os.O_CREAT, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Highest byte written to each pack by an indexed blob,
+	// including ones since deleted.
+	packEnd := make(map[int]int64)
+	lastPack := 0
+
+	var validBytes int64
+	br := bufio.NewReader(f)
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadString('\n')
+		if err == os.EOF {
+			if line != "" {
+				log.Printf("packed: ignoring torn final index record %q in %s", line, indexName)
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 5 && fields[0] == "put":
+			pack, err1 := strconv.Atoi(fields[2])
+			offset, err2 := strconv.Atoi64(fields[3])
+			size, err3 := strconv.Atoi64(fields[4])
+			if err1 != nil || err2 != nil || err3 != nil {
+				f.Close()
+				return os.NewError(fmt.Sprintf("packed: malformed index line %d in %s", lineNum, indexName))
+			}
+			ps.index[fields[1]] = blobLocation{pack: pack, offset: offset, size: size}
+			if end := offset + size; end > packEnd[pack] {
+				packEnd[pack] = end
+			}
+			if pack > lastPack {
+				lastPack = pack
+			}
+		case len(fields) == 2 && fields[0] == "del":
+			ps.index[fields[1]] = blobLocation{}, false
+		default:
+			f.Close()
+			return os.NewError(fmt.Sprintf("packed: malformed index line %d in %s", lineNum, indexName))
+		}
+		validBytes += int64(len(line))
+	}
+
+	if err = f.Truncate(validBytes); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Seek(validBytes, 0); err != nil {
+		f.Close()
+		return err
+	}
+	ps.indexFile = f
+
+	// A pack newer than any indexed blob may exist if we crashed
+	// right after rotating; append to it rather than skipping it.
+	for {
+		if _, err := os.Stat(ps.packFileName(lastPack + 1)); err != nil {
+			break
+		}
+		lastPack++
+	}
+	if err = ps.openPack(lastPack); err != nil {
+		return err
+	}
+	if ps.curSize > packEnd[lastPack] {
+		log.Printf("packed: truncating torn tail of %s from %d to %d bytes",
+			ps.packFileName(lastPack), ps.curSize, packEnd[lastPack])
+		if err = ps.curFile.Truncate(packEnd[lastPack]); err != nil {
+			return err
+		}
+		ps.curSize = packEnd[lastPack]
+	}
+
+	ps.sorted = make([]string, 0, len(ps.index))
+	for key, _ := range ps.index {
+		ps.sorted = append(ps.sorted, key)
+	}
+	sort.SortStrings(ps.sorted)
+	return nil
+}
+
+// openPack makes pack number n the one new blobs are appended to.
+func (ps *packStorage) openPack(n int) os.Error {
+	f, err := os.Open(ps.packFileName(n), os.O_RDWR|os.O_CREAT, 0600)
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if ps.curFile != nil {
+		ps.curFile.Close()
+	}
+	ps.curPack = n
+	ps.curFile = f
+	ps.curSize = size
+	return nil
+}
+
+// appendIndex durably appends a record to the index file.  If it
+// fails, the file is cut back to where it was, so that a partly
+// written record can't end up in the middle of the index once later
+// records follow it.
+func (ps *packStorage) appendIndex(record string) os.Error {
+	start, err := ps.indexFile.Seek(0, 1)
+	if err != nil {
+		return err
+	}
+	if _, err = ps.indexFile.WriteString(record); err == nil {
+		err = ps.indexFile.Sync()
+	}
+	if err != nil {
+		if terr := ps.indexFile.Truncate(start); terr != nil {
+			log.Printf("packed: can't remove torn index record: %v", terr)
+		}
+		ps.indexFile.Seek(start, 0)
+	}
+	return err
+}
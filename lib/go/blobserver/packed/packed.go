@@ -0,0 +1,315 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package packed implements a blobserver.Storage that appends blobs
+// into large pack files rather than writing one file per blob.
+//
+// A root directory contains numbered pack files ("pack-000000.dat",
+// "pack-000001.dat", ...) holding the raw concatenated bytes of each
+// blob, and a sidecar "index" file of newline-terminated records:
+//
+//   put <blobref> <pack> <offset> <size>
+//   del <blobref>
+//
+// Blob bytes are synced to their pack before the corresponding "put"
+// line is appended to the index, so after a crash any bytes in the
+// current pack past the last indexed blob (and any partial final line
+// in the index) are a torn append and are truncated on startup.
+//
+// Incoming blobs are first spooled to a "spool-*" file in the root
+// and verified there, so only the copy into the pack holds up other
+// writers.  A crash can leave a spool file behind; it's never read and
+// may be deleted.
+package packed
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Pack files are rotated once they grow past this size.
+const defaultMaxPackSize = 512 << 20
+
+type blobLocation struct {
+	pack   int
+	offset int64
+	size   int64
+}
+
+type packStorage struct {
+	root        string
+	maxPackSize int64
+
+	mu     sync.RWMutex            // guards index and sorted
+	index  map[string]blobLocation // blobref string -> location
+	sorted []string                // sorted keys of index
+
+	writeMu   sync.Mutex // serializes appends to the pack and index files
+	indexFile *os.File
+	curPack   int
+	curFile   *os.File
+	curSize   int64
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("packed", newFromConfig)
+}
+
+func newFromConfig(config map[string]interface{}) (blobserver.Storage, os.Error) {
+	root, err := blobserver.ConfigString(config, "root", "")
+	if err != nil {
+		return nil, err
+	}
+	return New(root)
+}
+
+func New(root string) (storage blobserver.Storage, err os.Error) {
+	fi, staterr := os.Stat(root)
+	if staterr != nil || !fi.IsDirectory() {
+		err = os.NewError(fmt.Sprintf("Storage root %q doesn't exist or is not a directory.", root))
+		return
+	}
+	ps := &packStorage{
+		root:        root,
+		maxPackSize: defaultMaxPackSize,
+		index:       make(map[string]blobLocation),
+	}
+	if err = ps.openIndex(); err != nil {
+		return
+	}
+	storage = ps
+	return
+}
+
+func (ps *packStorage) packFileName(pack int) string {
+	return fmt.Sprintf("%s/pack-%06d.dat", ps.root, pack)
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+func (ps *packStorage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	ps.mu.RLock()
+	loc, ok := ps.index[blob.String()]
+	ps.mu.RUnlock()
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	file, err := os.Open(ps.packFileName(loc.pack), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &sectionReadCloser{io.NewSectionReader(file, loc.offset, loc.size), file}, loc.size, nil
+}
+
+// BlobModTime returns the modification time of the pack holding blob,
+// which is when the newest blob in that pack was stored.
+func (ps *packStorage) BlobModTime(blob *blobref.BlobRef) (int64, os.Error) {
+	ps.mu.RLock()
+	loc, ok := ps.index[blob.String()]
+	ps.mu.RUnlock()
+	if !ok {
+		return 0, os.ENOENT
+	}
+	fi, err := os.Stat(ps.packFileName(loc.pack))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Mtime_ns, nil
+}
+
+func (ps *packStorage) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	ps.mu.RLock()
+	found := make([]*blobref.SizedBlobRef, 0, len(blobs))
+	for _, blob := range blobs {
+		if loc, ok := ps.index[blob.String()]; ok {
+			found = append(found, &blobref.SizedBlobRef{BlobRef: blob, Size: loc.size})
+		}
+	}
+	ps.mu.RUnlock()
+	for _, sb := range found {
+		dest <- sb
+	}
+	return nil
+}
+
+func (ps *packStorage) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	defer close(dest)
+	ps.mu.RLock()
+	found := make([]*blobref.SizedBlobRef, 0)
+	for i := sort.SearchStrings(ps.sorted, after); i < len(ps.sorted) && uint(len(found)) < limit; i++ {
+		key := ps.sorted[i]
+		if key <= after {
+			continue
+		}
+		if br := blobref.Parse(key); br != nil {
+			found = append(found, &blobref.SizedBlobRef{BlobRef: br, Size: ps.index[key].size})
+		}
+	}
+	ps.mu.RUnlock()
+	for _, sb := range found {
+		dest <- sb
+	}
+	return nil
+}
+
+func (ps *packStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	hash := blob.Hash()
+	if hash == nil {
+		return nil, os.NewError("unsupported blobref hash function")
+	}
+
+	ps.mu.RLock()
+	loc, have := ps.index[blob.String()]
+	ps.mu.RUnlock()
+	if have {
+		// Still verify what the client sent, but don't append
+		// a second copy.
+		if _, err := io.Copy(hash, source); err != nil {
+			return nil, err
+		}
+		if !blob.HashMatches(hash) {
+			return nil, blobserver.CorruptBlobError
+		}
+		return &blobref.SizedBlobRef{BlobRef: blob, Size: loc.size}, nil
+	}
+
+	// Read and verify the blob without holding writeMu, which
+	// would stall every other upload behind a slow client.
+	spool, err := ioutil.TempFile(ps.root, "spool-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(io.MultiWriter(hash, spool), source)
+	if err != nil {
+		return nil, err
+	}
+	if !blob.HashMatches(hash) {
+		return nil, blobserver.CorruptBlobError
+	}
+	if _, err = spool.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	ps.writeMu.Lock()
+	defer ps.writeMu.Unlock()
+
+	ps.mu.RLock()
+	loc, have = ps.index[blob.String()]
+	ps.mu.RUnlock()
+	if have {
+		// Another upload of the same blob got there first.
+		return &blobref.SizedBlobRef{BlobRef: blob, Size: loc.size}, nil
+	}
+
+	if ps.curSize >= ps.maxPackSize {
+		if err := ps.openPack(ps.curPack + 1); err != nil {
+			return nil, err
+		}
+	}
+
+	start := ps.curSize
+	success := false
+	defer func() {
+		if !success {
+			// Drop whatever part of the blob made it into the pack.
+			ps.curFile.Truncate(start)
+		}
+	}()
+
+	if _, err := ps.curFile.Seek(start, 0); err != nil {
+		return nil, err
+	}
+	written, err := io.Copy(ps.curFile, spool)
+	if err != nil {
+		return nil, err
+	}
+	if written != size {
+		return nil, io.ErrShortWrite
+	}
+	if err = ps.curFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	loc = blobLocation{pack: ps.curPack, offset: start, size: written}
+	if err = ps.appendIndex(fmt.Sprintf("put %s %d %d %d\n", blob.String(), loc.pack, loc.offset, loc.size)); err != nil {
+		return nil, err
+	}
+	success = true
+	ps.curSize = start + written
+
+	ps.mu.Lock()
+	ps.addToIndex(blob.String(), loc)
+	ps.mu.Unlock()
+	return &blobref.SizedBlobRef{BlobRef: blob, Size: written}, nil
+}
+
+// RemoveBlobs only removes the blobs from the index.  The space they
+// occupy in their pack files is not reclaimed.
+func (ps *packStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	ps.writeMu.Lock()
+	defer ps.writeMu.Unlock()
+	for _, blob := range blobs {
+		key := blob.String()
+		ps.mu.RLock()
+		_, have := ps.index[key]
+		ps.mu.RUnlock()
+		if !have {
+			continue
+		}
+		if err := ps.appendIndex("del " + key + "\n"); err != nil {
+			return err
+		}
+		ps.mu.Lock()
+		ps.removeFromIndex(key)
+		ps.mu.Unlock()
+	}
+	return nil
+}
+
+// addToIndex must be called with ps.mu held for writing.
+func (ps *packStorage) addToIndex(key string, loc blobLocation) {
+	if _, dup := ps.index[key]; !dup {
+		i := sort.SearchStrings(ps.sorted, key)
+		ps.sorted = append(ps.sorted, "")
+		copy(ps.sorted[i+1:], ps.sorted[i:])
+		ps.sorted[i] = key
+	}
+	ps.index[key] = loc
+}
+
+// removeFromIndex must be called with ps.mu held for writing.
+func (ps *packStorage) removeFromIndex(key string) {
+	if _, ok := ps.index[key]; !ok {
+		return
+	}
+	ps.index[key] = blobLocation{}, false
+	i := sort.SearchStrings(ps.sorted, key)
+	if i < len(ps.sorted) && ps.sorted[i] == key {
+		copy(ps.sorted[i:], ps.sorted[i+1:])
+		ps.sorted = ps.sorted[:len(ps.sorted)-1]
+	}
+}
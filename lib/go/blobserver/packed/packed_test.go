@@ -0,0 +1,237 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package packed
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func refOf(s string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(s))
+	return blobref.FromHash("sha1", s1)
+}
+
+func tempRoot(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "camli-packed-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	return dir
+}
+
+func receiveString(t *testing.T, s blobserver.Storage, contents string) *blobref.BlobRef {
+	br := refOf(contents)
+	sb, err := s.ReceiveBlob(br, strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("ReceiveBlob(%q): %v", contents, err)
+	}
+	if sb.Size != int64(len(contents)) {
+		t.Fatalf("ReceiveBlob(%q) size = %d", contents, sb.Size)
+	}
+	return br
+}
+
+func fetchString(t *testing.T, s blobserver.Storage, br *blobref.BlobRef) string {
+	r, size, err := s.Fetch(br)
+	if err != nil {
+		t.Fatalf("Fetch(%s): %v", br, err)
+	}
+	defer r.Close()
+	all, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Fetch(%s) read: %v", br, err)
+	}
+	if int64(len(all)) != size {
+		t.Errorf("Fetch(%s) returned size %d, read %d bytes", br, size, len(all))
+	}
+	return string(all)
+}
+
+func enumerateAll(t *testing.T, s blobserver.Storage) []string {
+	ch := make(chan *blobref.SizedBlobRef)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- s.EnumerateBlobs(ch, "", 1000)
+	}()
+	got := make([]string, 0)
+	for sb := range ch {
+		got = append(got, sb.BlobRef.String())
+	}
+	if err := <-errch; err != nil {
+		t.Fatalf("EnumerateBlobs: %v", err)
+	}
+	return got
+}
+
+func TestReceiveFetchEnumerate(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+	s, err := New(root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	foo := receiveString(t, s, "foo")
+	bar := receiveString(t, s, "bar")
+	receiveString(t, s, "foo") // duplicate; shouldn't be appended again
+
+	if got := fetchString(t, s, foo); got != "foo" {
+		t.Errorf("fetch foo = %q", got)
+	}
+	if got := fetchString(t, s, bar); got != "bar" {
+		t.Errorf("fetch bar = %q", got)
+	}
+
+	fi, err := os.Stat(root + "/pack-000000.dat")
+	if err != nil || fi.Size != 6 {
+		t.Errorf("expected 6 byte pack file; got %v, %v", fi, err)
+	}
+
+	got := enumerateAll(t, s)
+	if len(got) != 2 || got[0] >= got[1] {
+		t.Errorf("enumerate = %q; want 2 sorted blobs", got)
+	}
+
+	if err := s.RemoveBlobs([]*blobref.BlobRef{foo}); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if _, _, err := s.Fetch(foo); err != os.ENOENT {
+		t.Errorf("Fetch of removed blob; got err %v, want ENOENT", err)
+	}
+
+	// Everything should survive a reopen.
+	s, err = New(root)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := enumerateAll(t, s); len(got) != 1 || got[0] != bar.String() {
+		t.Errorf("enumerate after reopen = %q", got)
+	}
+}
+
+func TestCorruptBlobNotStored(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+	s, err := New(root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = s.ReceiveBlob(refOf("foo"), strings.NewReader("not foo"))
+	if err != blobserver.CorruptBlobError {
+		t.Fatalf("expected CorruptBlobError; got %v", err)
+	}
+	fi, err := os.Stat(root + "/pack-000000.dat")
+	if err != nil || fi.Size != 0 {
+		t.Errorf("expected empty pack after corrupt upload; got %v, %v", fi, err)
+	}
+}
+
+func TestTornTailRecovery(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+	s, err := New(root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	foo := receiveString(t, s, "foo")
+
+	// Simulate a crash mid-append: junk at the end of the pack
+	// and a partial record at the end of the index.
+	appendTo := func(name, data string) {
+		f, err := os.Open(root+"/"+name, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+	appendTo("pack-000000.dat", "partial blob bytes")
+	appendTo("index", "put sha1-abc")
+
+	s, err = New(root)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := enumerateAll(t, s); len(got) != 1 || got[0] != foo.String() {
+		t.Errorf("enumerate after recovery = %q", got)
+	}
+	fi, err := os.Stat(root + "/pack-000000.dat")
+	if err != nil || fi.Size != 3 {
+		t.Errorf("expected pack truncated to 3 bytes; got %v, %v", fi, err)
+	}
+
+	bar := receiveString(t, s, "bar")
+	if got := fetchString(t, s, bar); got != "bar" {
+		t.Errorf("fetch bar after recovery = %q", got)
+	}
+	if got := fetchString(t, s, foo); got != "foo" {
+		t.Errorf("fetch foo after recovery = %q", got)
+	}
+}
+
+func TestSlowUploadDoesNotBlockOthers(t *testing.T) {
+	root := tempRoot(t)
+	defer os.RemoveAll(root)
+	s, err := New(root)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	slow := refOf("slow blob")
+	pr, pw := io.Pipe()
+	slowDone := make(chan os.Error, 1)
+	go func() {
+		_, err := s.ReceiveBlob(slow, pr)
+		slowDone <- err
+	}()
+	pw.Write([]byte("slow "))
+
+	fastDone := make(chan bool, 1)
+	go func() {
+		receiveString(t, s, "fast blob")
+		fastDone <- true
+	}()
+	select {
+	case <-fastDone:
+	case <-time.After(5e9):
+		t.Fatalf("ReceiveBlob blocked behind a slow upload")
+	}
+
+	pw.Write([]byte("blob"))
+	pw.Close()
+	if err := <-slowDone; err != nil {
+		t.Fatalf("slow ReceiveBlob: %v", err)
+	}
+	if got := fetchString(t, s, slow); got != "slow blob" {
+		t.Errorf("Fetch(slow) = %q", got)
+	}
+	names, _ := ioutil.ReadDir(root)
+	for _, fi := range names {
+		if strings.HasPrefix(fi.Name, "spool-") {
+			t.Errorf("spool file %s left behind", fi.Name)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"camli/blobref"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// PartialUpload describes the beginning of an interrupted upload,
+// which a storage kept so the client can resume it instead of
+// starting again.  See doc/protocol/blob-upload-resume.txt.
+type PartialUpload struct {
+	BlobRef     *blobref.BlobRef // the blob being uploaded
+	Size        int64            // how many of its bytes were received
+	PartBlobRef *blobref.BlobRef // digest of those bytes
+}
+
+// ResumeKey returns the multipart form name under which a client
+// uploads the rest of the blob.
+func (p *PartialUpload) ResumeKey() string {
+	return fmt.Sprintf("resume-%s-%d-%s", p.BlobRef, p.Size, p.PartBlobRef)
+}
+
+var resumeKeyPattern = regexp.MustCompile(`^resume-([a-z0-9]+-[a-f0-9]+)-([0-9]+)-([a-z0-9]+-[a-f0-9]+)$`)
+
+// ParseResumeKey parses a key from ResumeKey, returning nil if it's
+// malformed.
+func ParseResumeKey(key string) *PartialUpload {
+	m := resumeKeyPattern.FindStringSubmatch(key)
+	if m == nil {
+		return nil
+	}
+	blob, partBlob := blobref.Parse(m[1]), blobref.Parse(m[3])
+	size, err := strconv.Atoi64(m[2])
+	if blob == nil || partBlob == nil || err != nil || size <= 0 ||
+		blob.HashName() != partBlob.HashName() {
+		return nil
+	}
+	return &PartialUpload{BlobRef: blob, Size: size, PartBlobRef: partBlob}
+}
+
+// PartialUploadStorage is implemented by storage that keeps what it
+// received of an upload that failed part way through reading its
+// source.
+type PartialUploadStorage interface {
+	// PartialUploads returns the partial uploads kept for blob.
+	PartialUploads(blob *blobref.BlobRef) ([]*PartialUpload, os.Error)
+
+	// ResumeBlob is like ReceiveBlob, but the blob's contents
+	// are the bytes kept for partial followed by those read from
+	// source.  Once it returns, partial is no longer kept,
+	// though if reading source fails, a longer partial upload
+	// may be kept in its place.
+	ResumeBlob(partial *PartialUpload, source io.Reader) (*blobref.SizedBlobRef, os.Error)
+
+	// RemovePartialUploads discards any partial uploads of blob.
+	RemovePartialUploads(blob *blobref.BlobRef) os.Error
+}
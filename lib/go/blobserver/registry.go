@@ -0,0 +1,109 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// A StorageConstructor returns a Storage built from config, a JSON
+// object whose "type" key named this constructor.
+type StorageConstructor func(config map[string]interface{}) (Storage, os.Error)
+
+var (
+	constructorMu sync.Mutex
+	constructors  = make(map[string]StorageConstructor)
+)
+
+// RegisterStorageConstructor makes a storage type available to
+// CreateStorage.  It's meant to be called from the init function of
+// each backend package.
+func RegisterStorageConstructor(typ string, ctor StorageConstructor) {
+	constructorMu.Lock()
+	defer constructorMu.Unlock()
+	if _, dup := constructors[typ]; dup {
+		panic("blobserver: duplicate storage type " + typ)
+	}
+	constructors[typ] = ctor
+}
+
+// CreateStorage constructs the Storage described by config, e.g.
+//
+//   {"type": "localdisk", "root": "/var/camlistore"}
+//
+// Storage types that wrap other storages take further such objects
+// as parameters.
+func CreateStorage(config map[string]interface{}) (Storage, os.Error) {
+	typ, ok := config["type"].(string)
+	if !ok {
+		return nil, os.NewError("storage config lacks a string \"type\"")
+	}
+	constructorMu.Lock()
+	ctor, ok := constructors[typ]
+	constructorMu.Unlock()
+	if !ok {
+		return nil, os.NewError(fmt.Sprintf("unknown storage type %q", typ))
+	}
+	return ctor(config)
+}
+
+// ConfigString returns the string value of key in config.  If key is
+// absent, def is returned; if def is "" the key is required.
+func ConfigString(config map[string]interface{}, key, def string) (string, os.Error) {
+	v, ok := config[key]
+	if !ok {
+		if def == "" {
+			return "", os.NewError(fmt.Sprintf("storage config missing required %q", key))
+		}
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", os.NewError(fmt.Sprintf("storage config %q must be a string", key))
+	}
+	return s, nil
+}
+
+// ConfigInt returns the integer value of key in config, or def if
+// key is absent.
+func ConfigInt(config map[string]interface{}, key string, def int64) (int64, os.Error) {
+	v, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f != float64(int64(f)) {
+		return 0, os.NewError(fmt.Sprintf("storage config %q must be an integer", key))
+	}
+	return int64(f), nil
+}
+
+// ConfigBool returns the boolean value of key in config, or def if
+// key is absent.
+func ConfigBool(config map[string]interface{}, key string, def bool) (bool, os.Error) {
+	v, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, os.NewError(fmt.Sprintf("storage config %q must be a boolean", key))
+	}
+	return b, nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package remote implements a blobserver.Storage backed by another
+// blob server, spoken to over the regular blob server protocol.
+//
+// Example config:
+//
+//   {"type": "remote",
+//    "url": "http://camli.example.com:3179",
+//    "password": "..."}
+package remote
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/client"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type remoteStorage struct {
+	client *client.Client
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("remote", newFromConfig)
+}
+
+func newFromConfig(config map[string]interface{}) (blobserver.Storage, os.Error) {
+	url, err := blobserver.ConfigString(config, "url", "")
+	if err != nil {
+		return nil, err
+	}
+	password, _ := config["password"].(string)
+	return New(url, password), nil
+}
+
+// New returns a Storage keeping its blobs on the blob server at url.
+func New(url, password string) blobserver.Storage {
+	return &remoteStorage{client: client.New(url, password)}
+}
+
+func (rs *remoteStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	hash := blob.Hash()
+	if hash == nil {
+		return nil, os.NewError("unsupported blobref hash function")
+	}
+
+	// The upload needs its size up front, and we mustn't pass on a
+	// corrupt blob, so spool it to disk first.
+	tempFile, err := ioutil.TempFile("", "camli-remote-upload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	size, err := io.Copy(io.MultiWriter(hash, tempFile), source)
+	if err != nil {
+		return nil, err
+	}
+	if !blob.HashMatches(hash) {
+		return nil, blobserver.CorruptBlobError
+	}
+	if _, err = tempFile.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	pr, err := rs.client.Upload(&client.UploadHandle{BlobRef: blob, Size: size, Contents: tempFile})
+	if err != nil {
+		return nil, err
+	}
+	return &blobref.SizedBlobRef{BlobRef: pr.BlobRef, Size: pr.Size}, nil
+}
+
+func (rs *remoteStorage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	return rs.client.Fetch(blob)
+}
+
+func (rs *remoteStorage) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	return rs.client.Stat(dest, blobs)
+}
+
+func (rs *remoteStorage) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	return rs.client.EnumerateBlobs(dest, after, limit)
+}
+
+func (rs *remoteStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	return rs.client.RemoveBlobs(blobs)
+}
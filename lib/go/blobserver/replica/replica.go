@@ -0,0 +1,304 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package replica implements a blobserver.Storage that writes each
+// blob to several other storages ("replicas").
+//
+// An upload only succeeds once a configurable minimum number of
+// replicas have it.  Each upload is first spooled to a temporary file
+// and then sent to all replicas at once, so a slow replica doesn't
+// hold up the others.  Reads go to the first replica that has the
+// blob, and enumeration merges the sorted listings of all replicas.
+//
+// Partial uploads can be resumed if every replica keeps them, and
+// sweeping temporary files sweeps every replica that has any.
+//
+// Example config:
+//
+//   {"type": "replica",
+//    "minWritesForSuccess": 2,
+//    "backends": [
+//       {"type": "localdisk", "root": "/var/camlistore"},
+//       {"type": "s3", "bucket": "...", ...}
+//    ]}
+package replica
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type replicaStorage struct {
+	replicas  []blobserver.Storage
+	minWrites int
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("replica", newFromConfig)
+}
+
+func newFromConfig(config map[string]interface{}) (blobserver.Storage, os.Error) {
+	backendConfigs, ok := config["backends"].([]interface{})
+	if !ok || len(backendConfigs) == 0 {
+		return nil, os.NewError("replica storage config requires a non-empty \"backends\" array")
+	}
+	replicas := make([]blobserver.Storage, len(backendConfigs))
+	for i, bc := range backendConfigs {
+		m, ok := bc.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError(fmt.Sprintf("replica backend %d isn't a JSON object", i))
+		}
+		s, err := blobserver.CreateStorage(m)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("replica backend %d: %v", i, err))
+		}
+		replicas[i] = s
+	}
+	minWrites, err := blobserver.ConfigInt(config, "minWritesForSuccess", int64(len(replicas)))
+	if err != nil {
+		return nil, err
+	}
+	return New(replicas, int(minWrites))
+}
+
+// New returns a Storage writing to all of replicas, where an upload
+// succeeds if at least minWrites of them succeed.
+func New(replicas []blobserver.Storage, minWrites int) (blobserver.Storage, os.Error) {
+	if minWrites < 1 || minWrites > len(replicas) {
+		return nil, os.NewError(fmt.Sprintf("replica: minWritesForSuccess must be between 1 and %d", len(replicas)))
+	}
+	return &replicaStorage{replicas: replicas, minWrites: minWrites}, nil
+}
+
+// failAtEOF reads from r, then fails with err instead of os.EOF.
+type failAtEOF struct {
+	r   io.Reader
+	err os.Error
+}
+
+func (f *failAtEOF) Read(p []byte) (int, os.Error) {
+	n, err := f.r.Read(p)
+	if err == os.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+type receiveResult struct {
+	sb  *blobref.SizedBlobRef
+	err os.Error
+}
+
+func (rs *replicaStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	return rs.fanOut(blob, source, func(replica blobserver.Storage, r io.Reader) (*blobref.SizedBlobRef, os.Error) {
+		return replica.ReceiveBlob(blob, r)
+	})
+}
+
+// fanOut spools source to a temporary file, then has send deliver it
+// to every replica in parallel.  If reading source fails, each
+// replica is still sent what was read, followed by the same error, so
+// that those keeping partial uploads can keep this one.
+func (rs *replicaStorage) fanOut(blob *blobref.BlobRef, source io.Reader,
+	send func(replica blobserver.Storage, r io.Reader) (*blobref.SizedBlobRef, os.Error)) (*blobref.SizedBlobRef, os.Error) {
+	spool, err := ioutil.TempFile("", "camli-replica")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, copyErr := io.Copy(spool, source)
+
+	n := len(rs.replicas)
+	resultc := make(chan receiveResult, n)
+	for _, replica := range rs.replicas {
+		go func(replica blobserver.Storage) {
+			var r io.Reader = io.NewSectionReader(spool, 0, size)
+			if copyErr != nil {
+				r = &failAtEOF{r, copyErr}
+			}
+			sb, err := send(replica, r)
+			resultc <- receiveResult{sb, err}
+		}(replica)
+	}
+
+	var got *blobref.SizedBlobRef
+	errs := make([]os.Error, 0)
+	corrupt := false
+	for i := 0; i < n; i++ {
+		res := <-resultc
+		if res.err != nil {
+			errs = append(errs, res.err)
+			if res.err == blobserver.CorruptBlobError {
+				corrupt = true
+			}
+			continue
+		}
+		got = res.sb
+	}
+	if copyErr != nil {
+		return nil, copyErr
+	}
+	if corrupt {
+		return nil, blobserver.CorruptBlobError
+	}
+	if succeeded := n - len(errs); succeeded < rs.minWrites {
+		return nil, &blobserver.PartialWriteError{Blob: blob, Succeeded: succeeded, Required: rs.minWrites, Errors: errs}
+	}
+	return got, nil
+}
+
+func (rs *replicaStorage) Fetch(blob *blobref.BlobRef) (file blobref.ReadSeekCloser, size int64, err os.Error) {
+	for _, replica := range rs.replicas {
+		file, size, err = replica.Fetch(blob)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (rs *replicaStorage) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	need := make(map[string]*blobref.BlobRef)
+	for _, blob := range blobs {
+		need[blob.String()] = blob
+	}
+	var firstErr os.Error
+	for _, replica := range rs.replicas {
+		if len(need) == 0 {
+			break
+		}
+		ask := make([]*blobref.BlobRef, 0, len(need))
+		for _, blob := range need {
+			ask = append(ask, blob)
+		}
+		ch := make(chan *blobref.SizedBlobRef)
+		errch := make(chan os.Error, 1)
+		go func() {
+			errch <- replica.Stat(ch, ask)
+			close(ch)
+		}()
+		for sb := range ch {
+			key := sb.BlobRef.String()
+			if _, ok := need[key]; ok {
+				need[key] = nil, false
+				dest <- sb
+			}
+		}
+		if err := <-errch; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(need) > 0 {
+		// Some blobs are missing; if a replica errored they might
+		// have been there.
+		return firstErr
+	}
+	return nil
+}
+
+func (rs *replicaStorage) BlobModTime(blob *blobref.BlobRef) (int64, os.Error) {
+	return blobserver.NewestModTime(rs.replicas, blob)
+}
+
+func (rs *replicaStorage) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	sources := make([]blobserver.BlobEnumerator, len(rs.replicas))
+	for i, replica := range rs.replicas {
+		sources[i] = replica
+	}
+	return blobserver.MergedEnumerate(dest, sources, after, limit)
+}
+
+func (rs *replicaStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	var firstErr os.Error
+	for _, replica := range rs.replicas {
+		if err := replica.RemoveBlobs(blobs); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// PartialUploads returns the partial uploads of blob kept by every
+// replica, since only those can be resumed everywhere.
+func (rs *replicaStorage) PartialUploads(blob *blobref.BlobRef) ([]*blobserver.PartialUpload, os.Error) {
+	var common map[string]*blobserver.PartialUpload
+	for _, replica := range rs.replicas {
+		ps, ok := replica.(blobserver.PartialUploadStorage)
+		if !ok {
+			return nil, nil
+		}
+		partials, err := ps.PartialUploads(blob)
+		if err != nil {
+			return nil, err
+		}
+		have := make(map[string]*blobserver.PartialUpload)
+		for _, p := range partials {
+			key := p.ResumeKey()
+			if common == nil || common[key] != nil {
+				have[key] = p
+			}
+		}
+		common = have
+	}
+	var partials []*blobserver.PartialUpload
+	for _, p := range common {
+		partials = append(partials, p)
+	}
+	return partials, nil
+}
+
+func (rs *replicaStorage) ResumeBlob(partial *blobserver.PartialUpload, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	return rs.fanOut(partial.BlobRef, source, func(replica blobserver.Storage, r io.Reader) (*blobref.SizedBlobRef, os.Error) {
+		ps, ok := replica.(blobserver.PartialUploadStorage)
+		if !ok {
+			return nil, os.NewError("replica: backend doesn't keep partial uploads")
+		}
+		return ps.ResumeBlob(partial, r)
+	})
+}
+
+func (rs *replicaStorage) RemovePartialUploads(blob *blobref.BlobRef) os.Error {
+	var firstErr os.Error
+	for _, replica := range rs.replicas {
+		if ps, ok := replica.(blobserver.PartialUploadStorage); ok {
+			if err := ps.RemovePartialUploads(blob); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// SweepTempFiles sweeps each replica that implements
+// blobserver.TempFileSweeper.
+func (rs *replicaStorage) SweepTempFiles() (int, os.Error) {
+	removed := 0
+	for _, replica := range rs.replicas {
+		if sweeper, ok := replica.(blobserver.TempFileSweeper); ok {
+			n, err := sweeper.SweepTempFiles()
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
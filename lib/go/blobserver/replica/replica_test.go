@@ -0,0 +1,271 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replica
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func refOf(s string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(s))
+	return blobref.FromHash("sha1", s1)
+}
+
+// brokenStorage fails every upload after reading a byte of it.
+type brokenStorage struct {
+	blobserver.Storage
+}
+
+func (brokenStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	source.Read(make([]byte, 1))
+	return nil, os.NewError("disk on fire")
+}
+
+func TestReceiveQuorum(t *testing.T) {
+	a, b := memory.New(), memory.New()
+	broken := brokenStorage{memory.New()}
+
+	s, err := New([]blobserver.Storage{a, broken, b}, 2)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	foo := refOf("foo")
+	sb, err := s.ReceiveBlob(foo, strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("ReceiveBlob with 2 of 3 replicas working: %v", err)
+	}
+	if sb.Size != 3 {
+		t.Errorf("size = %d; want 3", sb.Size)
+	}
+	for i, replica := range []blobserver.Storage{a, b} {
+		if _, _, err := replica.Fetch(foo); err != nil {
+			t.Errorf("replica %d missing blob: %v", i, err)
+		}
+	}
+
+	if _, err := s.ReceiveBlob(foo, strings.NewReader("not foo")); err != blobserver.CorruptBlobError {
+		t.Errorf("expected CorruptBlobError; got %v", err)
+	}
+
+	s, _ = New([]blobserver.Storage{a, broken, b}, 3)
+	bar := refOf("bar")
+	_, err = s.ReceiveBlob(bar, strings.NewReader("bar"))
+	pwe, ok := err.(*blobserver.PartialWriteError)
+	if !ok {
+		t.Fatalf("expected PartialWriteError; got %v", err)
+	}
+	if pwe.Succeeded != 2 || pwe.Required != 3 || len(pwe.Errors) != 1 {
+		t.Errorf("unexpected partial write error: %v", pwe)
+	}
+}
+
+func TestFetchStatEnumerate(t *testing.T) {
+	a, b := memory.New(), memory.New()
+	for _, contents := range []string{"foo", "bar"} {
+		a.ReceiveBlob(refOf(contents), strings.NewReader(contents))
+	}
+	for _, contents := range []string{"bar", "baz"} {
+		b.ReceiveBlob(refOf(contents), strings.NewReader(contents))
+	}
+	s, _ := New([]blobserver.Storage{a, b}, 1)
+
+	r, _, err := s.Fetch(refOf("baz"))
+	if err != nil {
+		t.Fatalf("Fetch of blob only on second replica: %v", err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if string(got) != "baz" {
+		t.Errorf("Fetch = %q", got)
+	}
+	if _, _, err := s.Fetch(refOf("nope")); err == nil {
+		t.Errorf("expected error fetching missing blob")
+	}
+
+	statch := make(chan *blobref.SizedBlobRef, 10)
+	if err := s.Stat(statch, []*blobref.BlobRef{refOf("foo"), refOf("baz"), refOf("nope")}); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	close(statch)
+	n := 0
+	for _ = range statch {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("stat found %d blobs; want 2", n)
+	}
+
+	want := []string{refOf("foo").String(), refOf("bar").String(), refOf("baz").String()}
+	sort.SortStrings(want)
+	enumerate := func(after string, limit uint) []string {
+		ch := make(chan *blobref.SizedBlobRef)
+		go s.EnumerateBlobs(ch, after, limit)
+		refs := make([]string, 0)
+		for sb := range ch {
+			refs = append(refs, sb.BlobRef.String())
+		}
+		return refs
+	}
+	if refs := enumerate("", 10); strings.Join(refs, ",") != strings.Join(want, ",") {
+		t.Errorf("enumerate = %q; want %q", refs, want)
+	}
+	if refs := enumerate(want[0], 1); len(refs) != 1 || refs[0] != want[1] {
+		t.Errorf("enumerate after %s limit 1 = %q", want[0], refs)
+	}
+
+	s.RemoveBlobs([]*blobref.BlobRef{refOf("bar")})
+	for i, replica := range []blobserver.Storage{a, b} {
+		if _, _, err := replica.Fetch(refOf("bar")); err == nil {
+			t.Errorf("replica %d still has removed blob", i)
+		}
+	}
+}
+
+// slowStorage doesn't start reading an upload until released.
+type slowStorage struct {
+	blobserver.Storage
+	release chan bool
+}
+
+func (ss *slowStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	<-ss.release
+	return ss.Storage.ReceiveBlob(blob, source)
+}
+
+func TestSlowReplica(t *testing.T) {
+	fast := memory.New()
+	slow := &slowStorage{memory.New(), make(chan bool)}
+	s, _ := New([]blobserver.Storage{slow, fast}, 2)
+
+	contents := strings.Repeat("slow going ", 10000)
+	done := make(chan os.Error)
+	go func() {
+		_, err := s.ReceiveBlob(refOf(contents), strings.NewReader(contents))
+		done <- err
+	}()
+	for tries := 0; ; tries++ {
+		if _, _, err := fast.Fetch(refOf(contents)); err == nil {
+			break
+		}
+		if tries == 500 {
+			t.Fatalf("fast replica didn't get the blob while the slow one was stalled")
+		}
+		time.Sleep(10e6)
+	}
+	slow.release <- true
+	if err := <-done; err != nil {
+		t.Errorf("ReceiveBlob: %v", err)
+	}
+}
+
+// keepingStorage keeps what it read of failed uploads, like localdisk.
+type keepingStorage struct {
+	blobserver.Storage
+	partials map[string][]byte
+}
+
+func newKeepingStorage() *keepingStorage {
+	return &keepingStorage{memory.New(), make(map[string][]byte)}
+}
+
+func (ks *keepingStorage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	data, err := ioutil.ReadAll(source)
+	if err != nil {
+		ks.partials[blob.String()] = data
+		return nil, err
+	}
+	return ks.Storage.ReceiveBlob(blob, strings.NewReader(string(data)))
+}
+
+func (ks *keepingStorage) PartialUploads(blob *blobref.BlobRef) ([]*blobserver.PartialUpload, os.Error) {
+	data, ok := ks.partials[blob.String()]
+	if !ok {
+		return nil, nil
+	}
+	return []*blobserver.PartialUpload{&blobserver.PartialUpload{BlobRef: blob, Size: int64(len(data)), PartBlobRef: refOf(string(data))}}, nil
+}
+
+func (ks *keepingStorage) ResumeBlob(partial *blobserver.PartialUpload, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	data, ok := ks.partials[partial.BlobRef.String()]
+	if !ok {
+		return nil, os.ENOENT
+	}
+	ks.partials[partial.BlobRef.String()] = nil, false
+	return ks.ReceiveBlob(partial.BlobRef, io.MultiReader(strings.NewReader(string(data)), source))
+}
+
+func (ks *keepingStorage) RemovePartialUploads(blob *blobref.BlobRef) os.Error {
+	ks.partials[blob.String()] = nil, false
+	return nil
+}
+
+func (ks *keepingStorage) SweepTempFiles() (int, os.Error) {
+	n := len(ks.partials)
+	ks.partials = make(map[string][]byte)
+	return n, nil
+}
+
+type errorReader struct{}
+
+func (errorReader) Read(p []byte) (int, os.Error) {
+	return 0, os.NewError("connection reset")
+}
+
+func TestPartialUploads(t *testing.T) {
+	a, b := newKeepingStorage(), newKeepingStorage()
+	s, _ := New([]blobserver.Storage{a, b}, 2)
+	ps := s.(blobserver.PartialUploadStorage)
+
+	blob := refOf("hello world")
+	if _, err := s.ReceiveBlob(blob, io.MultiReader(strings.NewReader("hello "), errorReader{})); err == nil {
+		t.Fatalf("ReceiveBlob of a failing source succeeded")
+	}
+	partials, err := ps.PartialUploads(blob)
+	if err != nil || len(partials) != 1 || partials[0].Size != 6 {
+		t.Fatalf("PartialUploads = %v, %v; want one of 6 bytes", partials, err)
+	}
+	if _, err := ps.ResumeBlob(partials[0], strings.NewReader("world")); err != nil {
+		t.Fatalf("ResumeBlob: %v", err)
+	}
+	for i, replica := range []blobserver.Storage{a, b} {
+		if _, size, err := replica.Fetch(blob); err != nil || size != 11 {
+			t.Errorf("replica %d after resume: size %d, %v", i, size, err)
+		}
+	}
+
+	s.ReceiveBlob(blob, errorReader{})
+	if n, err := s.(blobserver.TempFileSweeper).SweepTempFiles(); n != 2 || err != nil {
+		t.Errorf("SweepTempFiles = %d, %v; want 2", n, err)
+	}
+
+	// Only partial uploads every replica kept are offered.
+	s, _ = New([]blobserver.Storage{newKeepingStorage(), memory.New()}, 1)
+	s.ReceiveBlob(blob, io.MultiReader(strings.NewReader("hello "), errorReader{}))
+	if partials, _ := s.(blobserver.PartialUploadStorage).PartialUploads(blob); len(partials) != 0 {
+		t.Errorf("PartialUploads with a replica not keeping them = %v; want none", partials)
+	}
+}
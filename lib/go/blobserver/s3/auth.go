@@ -0,0 +1,66 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"camli/http"
+	"crypto/hmac"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+)
+
+// signRequest adds the Date and Authorization headers to req, per
+// the S3 REST authentication scheme ("AWS" HMAC-SHA1 signatures).
+func (ss *s3Storage) signRequest(req *http.Request) {
+	if _, ok := req.Header["Date"]; !ok {
+		req.Header["Date"] = time.UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")
+	}
+	mac := hmac.NewSHA1([]byte(ss.secretAccessKey))
+	mac.Write([]byte(stringToSign(req)))
+	sum := mac.Sum()
+	sig := make([]byte, base64.StdEncoding.EncodedLen(len(sum)))
+	base64.StdEncoding.Encode(sig, sum)
+	req.Header["Authorization"] = "AWS " + ss.accessKey + ":" + string(sig)
+}
+
+func stringToSign(req *http.Request) string {
+	buf := new(bytes.Buffer)
+	buf.WriteString(req.Method + "\n")
+	buf.WriteString(req.Header["Content-MD5"] + "\n")
+	buf.WriteString(req.Header["Content-Type"] + "\n")
+	buf.WriteString(req.Header["Date"] + "\n")
+
+	amzHeaders := make([]string, 0)
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			amzHeaders = append(amzHeaders, k+":"+v+"\n")
+		}
+	}
+	sort.SortStrings(amzHeaders)
+	for _, h := range amzHeaders {
+		buf.WriteString(h)
+	}
+
+	// Only the path is signed, not the query string (we don't use
+	// any of the sub-resources that would need to be included).
+	buf.WriteString(req.URL.Path)
+	return buf.String()
+}
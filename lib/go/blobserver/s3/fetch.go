@@ -0,0 +1,106 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"camli/blobref"
+	"camli/http"
+	"fmt"
+	"io"
+	"os"
+)
+
+// objectReader reads an S3 object, issuing a new ranged GET whenever
+// the caller seeks.
+type objectReader struct {
+	ss   *s3Storage
+	blob *blobref.BlobRef
+	size int64
+
+	offset int64         // current read position
+	body   io.ReadCloser // response body positioned at offset, or nil
+}
+
+func (r *objectReader) Read(p []byte) (n int, err os.Error) {
+	if r.offset >= r.size {
+		return 0, os.EOF
+	}
+	if r.body == nil {
+		req := r.ss.newRequest("GET", r.blob.String(), nil)
+		req.Header["Range"] = fmt.Sprintf("bytes=%d-", r.offset)
+		r.ss.signRequest(req.Request)
+		resp, err := req.Send()
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && !(resp.StatusCode == http.StatusOK && r.offset == 0) {
+			resp.Body.Close()
+			return 0, os.NewError(fmt.Sprintf("s3: ranged GET of %s returned status %d", r.blob, resp.StatusCode))
+		}
+		r.body = resp.Body
+	}
+	n, err = r.body.Read(p)
+	r.offset += int64(n)
+	return
+}
+
+func (r *objectReader) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += r.offset
+	case 2:
+		offset += r.size
+	default:
+		return r.offset, os.EINVAL
+	}
+	if offset < 0 {
+		return r.offset, os.EINVAL
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *objectReader) Close() os.Error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+func (ss *s3Storage) Fetch(blob *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	req := ss.newRequest("GET", blob.String(), nil)
+	ss.signRequest(req.Request)
+	resp, err := req.Send()
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, os.ENOENT
+	default:
+		resp.Body.Close()
+		return nil, 0, os.NewError(fmt.Sprintf("s3: GET of %s returned status %d", blob, resp.StatusCode))
+	}
+	return &objectReader{ss: ss, blob: blob, size: resp.ContentLength, body: resp.Body}, resp.ContentLength, nil
+}
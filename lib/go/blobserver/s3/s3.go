@@ -0,0 +1,234 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package s3 implements a blobserver.Storage on Amazon S3 or any
+// service speaking the same REST protocol.  Each blob is stored as an
+// object in a single bucket, keyed by its blobref.
+package s3
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/http"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"xml"
+)
+
+// S3 returns at most this many keys per list request.
+const maxKeysPerList = 1000
+
+type s3Storage struct {
+	hostname        string // e.g. "s3.amazonaws.com"
+	bucket          string
+	accessKey       string
+	secretAccessKey string
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("s3", newFromConfig)
+}
+
+func newFromConfig(config map[string]interface{}) (blobserver.Storage, os.Error) {
+	ss := new(s3Storage)
+	var err os.Error
+	if ss.accessKey, err = blobserver.ConfigString(config, "aws_access_key", ""); err != nil {
+		return nil, err
+	}
+	if ss.secretAccessKey, err = blobserver.ConfigString(config, "aws_secret_access_key", ""); err != nil {
+		return nil, err
+	}
+	if ss.bucket, err = blobserver.ConfigString(config, "bucket", ""); err != nil {
+		return nil, err
+	}
+	if ss.hostname, err = blobserver.ConfigString(config, "hostname", "s3.amazonaws.com"); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// New returns a Storage keeping blobs in bucket on the S3-compatible
+// server at hostname ("host" or "host:port").
+func New(hostname, bucket, accessKey, secretAccessKey string) blobserver.Storage {
+	return &s3Storage{
+		hostname:        hostname,
+		bucket:          bucket,
+		accessKey:       accessKey,
+		secretAccessKey: secretAccessKey,
+	}
+}
+
+func (ss *s3Storage) objectUrl(key string) string {
+	return fmt.Sprintf("http://%s/%s/%s", ss.hostname, ss.bucket, key)
+}
+
+// newRequest returns an unsigned request for the object key, or for
+// the bucket itself if key is empty.
+func (ss *s3Storage) newRequest(method, key string, body io.Reader) *http.ClientRequest {
+	var req *http.ClientRequest
+	if body == nil {
+		req = http.NewGetRequest(ss.objectUrl(key))
+	} else {
+		req = http.NewPostRequest(ss.objectUrl(key), "application/octet-stream", body)
+	}
+	req.Method = method
+	return req
+}
+
+func (ss *s3Storage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (*blobref.SizedBlobRef, os.Error) {
+	hash := blob.Hash()
+	if hash == nil {
+		return nil, os.NewError("unsupported blobref hash function")
+	}
+
+	// S3 needs the Content-Length up front, and we mustn't store a
+	// blob whose digest doesn't match, so spool it to disk first.
+	tempFile, err := ioutil.TempFile("", "camli-s3-upload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	md5h := md5.New()
+	size, err := io.Copy(io.MultiWriter(hash, md5h, tempFile), source)
+	if err != nil {
+		return nil, err
+	}
+	if !blob.HashMatches(hash) {
+		return nil, blobserver.CorruptBlobError
+	}
+	if _, err = tempFile.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	req := ss.newRequest("PUT", blob.String(), tempFile)
+	req.ContentLength = size
+	req.TransferEncoding = nil
+	md5sum := md5h.Sum()
+	md5b64 := make([]byte, base64.StdEncoding.EncodedLen(len(md5sum)))
+	base64.StdEncoding.Encode(md5b64, md5sum)
+	req.Header["Content-MD5"] = string(md5b64)
+	ss.signRequest(req.Request)
+
+	resp, err := req.Send()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, os.NewError(fmt.Sprintf("s3: PUT of %s returned status %d", blob, resp.StatusCode))
+	}
+	return &blobref.SizedBlobRef{BlobRef: blob, Size: size}, nil
+}
+
+func (ss *s3Storage) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	for _, blob := range blobs {
+		req := ss.newRequest("HEAD", blob.String(), nil)
+		ss.signRequest(req.Request)
+		resp, err := req.Send()
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			dest <- &blobref.SizedBlobRef{BlobRef: blob, Size: resp.ContentLength}
+		case http.StatusNotFound:
+		default:
+			return os.NewError(fmt.Sprintf("s3: HEAD of %s returned status %d", blob, resp.StatusCode))
+		}
+	}
+	return nil
+}
+
+type listBucketResults struct {
+	Contents    []*listBucketEntry
+	IsTruncated bool
+}
+
+type listBucketEntry struct {
+	Key  string
+	Size int64
+}
+
+func (ss *s3Storage) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	defer close(dest)
+	marker := after
+	for limit > 0 {
+		maxKeys := limit
+		if maxKeys > maxKeysPerList {
+			maxKeys = maxKeysPerList
+		}
+		req := ss.newRequest("GET", "", nil)
+		req.URL.RawQuery = "marker=" + http.URLEscape(marker) + "&max-keys=" + strconv.Uitoa(maxKeys)
+		ss.signRequest(req.Request)
+		resp, err := req.Send()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return os.NewError(fmt.Sprintf("s3: list of bucket %s returned status %d", ss.bucket, resp.StatusCode))
+		}
+		var res listBucketResults
+		err = xml.Unmarshal(resp.Body, &res)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, entry := range res.Contents {
+			marker = entry.Key
+			br := blobref.Parse(entry.Key)
+			if br == nil {
+				// Not one of ours.
+				continue
+			}
+			dest <- &blobref.SizedBlobRef{BlobRef: br, Size: entry.Size}
+			limit--
+			if limit == 0 {
+				break
+			}
+		}
+		if !res.IsTruncated || len(res.Contents) == 0 {
+			break
+		}
+	}
+	return nil
+}
+
+func (ss *s3Storage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	for _, blob := range blobs {
+		req := ss.newRequest("DELETE", blob.String(), nil)
+		ss.signRequest(req.Request)
+		resp, err := req.Send()
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		default:
+			return os.NewError(fmt.Sprintf("s3: DELETE of %s returned status %d", blob, resp.StatusCode))
+		}
+	}
+	return nil
+}
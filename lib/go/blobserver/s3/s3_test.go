@@ -0,0 +1,250 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/http"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal in-memory S3 server: one bucket, path-style
+// URLs, and small list pages so pagination gets exercised.
+type fakeS3 struct {
+	bucket   string
+	pageSize int
+
+	mu            sync.Mutex
+	objects       map[string][]byte
+	rangedFetches int
+}
+
+func (f *fakeS3) ServeHTTP(conn http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header["Authorization"], "AWS testkey:") {
+		conn.WriteHeader(http.StatusForbidden)
+		return
+	}
+	parts := strings.Split(req.URL.Path[1:], "/", 2)
+	if parts[0] != f.bucket {
+		conn.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case req.Method == "GET" && key == "":
+		f.list(conn, req)
+	case req.Method == "PUT":
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			conn.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+	case req.Method == "GET" || req.Method == "HEAD":
+		obj, ok := f.objects[key]
+		if !ok {
+			conn.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rng, ok := req.Header["Range"]; ok {
+			var start int
+			if _, err := fmt.Sscanf(rng, "bytes=%d-", &start); err != nil || start > len(obj) {
+				conn.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			f.rangedFetches++
+			conn.SetHeader("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(obj)-1, len(obj)))
+			conn.SetHeader("Content-Length", strconv.Itoa(len(obj)-start))
+			conn.WriteHeader(http.StatusPartialContent)
+			conn.Write(obj[start:])
+			return
+		}
+		conn.SetHeader("Content-Length", strconv.Itoa(len(obj)))
+		conn.WriteHeader(http.StatusOK)
+		if req.Method == "GET" {
+			conn.Write(obj)
+		}
+	case req.Method == "DELETE":
+		f.objects[key] = nil, false
+		conn.WriteHeader(http.StatusNoContent)
+	default:
+		conn.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeS3) list(conn http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	marker := req.FormValue("marker")
+	maxKeys, err := strconv.Atoi(req.FormValue("max-keys"))
+	if err != nil || maxKeys > f.pageSize {
+		maxKeys = f.pageSize
+	}
+	keys := make([]string, 0)
+	for k, _ := range f.objects {
+		if k > marker {
+			keys = append(keys, k)
+		}
+	}
+	sort.SortStrings(keys)
+	truncated := len(keys) > maxKeys
+	if truncated {
+		keys = keys[:maxKeys]
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(buf, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+	fmt.Fprintf(buf, "<Name>%s</Name><Marker>%s</Marker><IsTruncated>%v</IsTruncated>", f.bucket, marker, truncated)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", k, len(f.objects[k]))
+	}
+	fmt.Fprintf(buf, "</ListBucketResult>")
+	conn.SetHeader("Content-Type", "application/xml")
+	conn.Write(buf.Bytes())
+}
+
+func refOf(s string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(s))
+	return blobref.FromHash("sha1", s1)
+}
+
+func startFakeS3(t *testing.T) (*fakeS3, blobserver.Storage, net.Listener) {
+	fake := &fakeS3{bucket: "testbucket", pageSize: 2, objects: make(map[string][]byte)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go http.Serve(listener, fake)
+	return fake, New(listener.Addr().String(), "testbucket", "testkey", "testsecret"), listener
+}
+
+func TestS3AgainstFakeServer(t *testing.T) {
+	fake, s, listener := startFakeS3(t)
+	defer listener.Close()
+
+	contents := []string{"foo", "bar", "baz", "quux", "camli"}
+	for _, c := range contents {
+		if _, err := s.ReceiveBlob(refOf(c), strings.NewReader(c)); err != nil {
+			t.Fatalf("ReceiveBlob(%q): %v", c, err)
+		}
+	}
+	fake.mu.Lock()
+	fake.objects["README"] = []byte("not a blob")
+	fake.mu.Unlock()
+
+	if _, err := s.ReceiveBlob(refOf("x"), strings.NewReader("y")); err != blobserver.CorruptBlobError {
+		t.Errorf("expected CorruptBlobError; got %v", err)
+	}
+	fake.mu.Lock()
+	_, stored := fake.objects[refOf("x").String()]
+	fake.mu.Unlock()
+	if stored {
+		t.Errorf("corrupt blob was stored")
+	}
+
+	r, size, err := s.Fetch(refOf("camli"))
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if size != 5 {
+		t.Errorf("Fetch size = %d; want 5", size)
+	}
+	if _, err := r.Seek(2, 0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	rest, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(rest) != "mli" {
+		t.Errorf("read after seek = %q, %v; want \"mli\"", rest, err)
+	}
+	fake.mu.Lock()
+	if fake.rangedFetches != 1 {
+		t.Errorf("expected 1 ranged GET; got %d", fake.rangedFetches)
+	}
+	fake.mu.Unlock()
+
+	if _, _, err := s.Fetch(refOf("missing")); err != os.ENOENT {
+		t.Errorf("Fetch of missing blob: got %v; want ENOENT", err)
+	}
+
+	statch := make(chan *blobref.SizedBlobRef, 10)
+	if err := s.Stat(statch, []*blobref.BlobRef{refOf("foo"), refOf("missing")}); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	close(statch)
+	n := 0
+	for sb := range statch {
+		if sb.BlobRef.String() != refOf("foo").String() || sb.Size != 3 {
+			t.Errorf("unexpected stat result %v", sb)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Errorf("Stat found %d blobs; want 1", n)
+	}
+
+	enumerate := func(after string, limit uint) []string {
+		ch := make(chan *blobref.SizedBlobRef)
+		errch := make(chan os.Error, 1)
+		go func() {
+			errch <- s.EnumerateBlobs(ch, after, limit)
+		}()
+		got := make([]string, 0)
+		for sb := range ch {
+			got = append(got, sb.BlobRef.String())
+		}
+		if err := <-errch; err != nil {
+			t.Fatalf("EnumerateBlobs: %v", err)
+		}
+		return got
+	}
+	want := make([]string, 0)
+	for _, c := range contents {
+		want = append(want, refOf(c).String())
+	}
+	sort.SortStrings(want)
+	if got := enumerate("", 100); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("enumerate all = %q; want %q", got, want)
+	}
+	if got := enumerate(want[0], 3); strings.Join(got, ",") != strings.Join(want[1:4], ",") {
+		t.Errorf("enumerate after %s limit 3 = %q; want %q", want[0], got, want[1:4])
+	}
+
+	if err := s.RemoveBlobs([]*blobref.BlobRef{refOf("foo"), refOf("missing")}); err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if got := enumerate("", 100); len(got) != 4 {
+		t.Errorf("expected 4 blobs after remove; got %q", got)
+	}
+}
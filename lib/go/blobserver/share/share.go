@@ -0,0 +1,267 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package share decides whether a chain of blobs, starting at a
+// "share" schema blob (see doc/schema/objects/share.txt), grants
+// access to the blob at its end.
+//
+// The share must be signed by one of the trusted signers.  Its target
+// is the second hop.  Each hop after that must be genuinely referred
+// to by the one before it: as a file's contentParts blobRef, a
+// directory's entries, or a static-set's members.  Chains longer than
+// the share and its target are only allowed for shares marked
+// "transitive".
+//
+// A share also stops granting access once its "expires" time has
+// passed, or once a trusted signer has signed a "share-revocation"
+// claim targeting it.
+package share
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonsign"
+	"camli/schema"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// An ExpiredError is returned by Authorize for a genuine share whose
+// expiry time has passed.
+type ExpiredError struct {
+	Share   *blobref.BlobRef
+	Expires int64 // nanoseconds since the epoch
+}
+
+func (e *ExpiredError) String() string {
+	return fmt.Sprintf("share %s expired at %s", e.Share,
+		time.SecondsToUTC(e.Expires/1e9).Format(time.RFC3339))
+}
+
+// A RevokedError is returned by Authorize for a genuine share that a
+// trusted signer has revoked.
+type RevokedError struct {
+	Share *blobref.BlobRef
+	Claim *blobref.BlobRef // the share-revocation claim
+}
+
+func (e *RevokedError) String() string {
+	return fmt.Sprintf("share %s was revoked by claim %s", e.Share, e.Claim)
+}
+
+type Authorizer struct {
+	Fetcher blobref.Fetcher
+
+	// TrustedSigners are the public key blobs whose shares are
+	// honored.  If empty, no share grants access.
+	TrustedSigners []*blobref.BlobRef
+
+	// VerifySignature reports whether a signed schema blob's
+	// signature is valid.  If nil, it's checked with jsonsign,
+	// fetching public keys from Fetcher.
+	VerifySignature func(sjson string) bool
+
+	lk      sync.Mutex
+	revoked map[string]*blobref.BlobRef // share blobref -> revocation claim
+}
+
+// refersTo reports whether b genuinely refers to blob, as part of its
+// contents.
+func refersTo(b *schema.Blob, blob *blobref.BlobRef) bool {
+	for _, ref := range b.ContentRefs() {
+		if br := blobref.Parse(ref); br != nil && br.String() == blob.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func hopError(hop int, blob *blobref.BlobRef, format string, args ...interface{}) os.Error {
+	return os.NewError(fmt.Sprintf("share chain hop %d (%s): %s", hop, blob, fmt.Sprintf(format, args...)))
+}
+
+// Authorize returns nil if chain, a share followed by the blobs
+// leading from it to the requested blob, grants access to its last
+// blob.  A chain of just a share grants access to the share itself.
+// Otherwise it returns an error describing the first bad hop, which
+// is an *ExpiredError or *RevokedError if the share itself is genuine
+// but no longer valid.
+func (a *Authorizer) Authorize(chain []*blobref.BlobRef) os.Error {
+	if len(chain) == 0 {
+		return os.NewError("empty share chain")
+	}
+	share, err := schema.FetchBlob(a.Fetcher, chain[0])
+	if err != nil {
+		return hopError(0, chain[0], "%v", err)
+	}
+	if share.Type() != "share" {
+		return hopError(0, chain[0], "not a share")
+	}
+	if err := a.checkSigner(share); err != nil {
+		return hopError(0, chain[0], "%v", err)
+	}
+	if authType := share.StringField("authType"); authType != "haveref" {
+		return hopError(0, chain[0], "unsupported authType %q", authType)
+	}
+	if claim := a.revocation(chain[0]); claim != nil {
+		return &RevokedError{Share: chain[0], Claim: claim}
+	}
+	expires, err := schema.ShareExpiresOf(share.Map)
+	if err != nil {
+		return hopError(0, chain[0], "%v", err)
+	}
+	if expires != 0 && time.Nanoseconds() >= expires {
+		return &ExpiredError{Share: chain[0], Expires: expires}
+	}
+	if len(chain) == 1 {
+		return nil
+	}
+
+	target := blobref.Parse(share.StringField("target"))
+	if target == nil || target.String() != chain[1].String() {
+		return hopError(0, chain[0], "share target is %q, not %s", share.StringField("target"), chain[1])
+	}
+	if transitive, _ := share.Map["transitive"].(bool); !transitive && len(chain) > 2 {
+		return hopError(0, chain[0], "share isn't transitive")
+	}
+	for i := 1; i < len(chain)-1; i++ {
+		sb, err := schema.FetchBlob(a.Fetcher, chain[i])
+		if err != nil {
+			return hopError(i, chain[i], "%v", err)
+		}
+		if !refersTo(sb, chain[i+1]) {
+			return hopError(i, chain[i], "no reference to %s", chain[i+1])
+		}
+	}
+	return nil
+}
+
+// revocation returns the claim revoking share, or nil.
+func (a *Authorizer) revocation(share *blobref.BlobRef) *blobref.BlobRef {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	return a.revoked[share.String()]
+}
+
+// NoteBlob records blob if it's a share-revocation claim signed by a
+// trusted signer.
+func (a *Authorizer) NoteBlob(blob *blobref.BlobRef) {
+	if len(a.TrustedSigners) == 0 {
+		return
+	}
+	sb, err := schema.FetchBlob(a.Fetcher, blob)
+	if err != nil {
+		return
+	}
+	if sb.Type() != "claim" || sb.StringField("claimType") != schema.ShareRevocationClaim {
+		return
+	}
+	target := blobref.Parse(sb.StringField("target"))
+	if target == nil {
+		log.Printf("share: ignoring revocation %s with bad target %q", blob, sb.StringField("target"))
+		return
+	}
+	if err := a.checkSigner(sb); err != nil {
+		log.Printf("share: ignoring revocation %s: %v", blob, err)
+		return
+	}
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if a.revoked == nil {
+		a.revoked = make(map[string]*blobref.BlobRef)
+	}
+	a.revoked[target.String()] = blob
+}
+
+// watchBufferSize is how many newly received blobs Watch queues
+// before the hub starts dropping notifications to it.
+const watchBufferSize = 1000
+
+// Watch calls NoteBlob for each blob announced on hub, so that
+// revocations take effect as soon as they're uploaded.  The blobs are
+// examined by a background goroutine, off the path of the uploads.
+// Servers should call Watch before LoadRevocations, so a revocation
+// arriving during the load isn't missed.
+func (a *Authorizer) Watch(hub blobserver.BlobHub) {
+	ch := make(chan *blobref.BlobRef, watchBufferSize)
+	hub.RegisterListener(ch)
+	go func() {
+		for blob := range ch {
+			a.NoteBlob(blob)
+		}
+	}()
+}
+
+// loadProgressInterval is how many blobs LoadRevocations examines
+// between progress messages.
+const loadProgressInterval = 100000
+
+// LoadRevocations calls NoteBlob for every blob in storage that could
+// be a schema blob, to find the revocations received before the
+// server started.  This reads every small blob, so it logs its
+// progress.
+func (a *Authorizer) LoadRevocations(storage blobserver.BlobEnumerator) os.Error {
+	start := time.Nanoseconds()
+	seen := 0
+	defer func() {
+		a.lk.Lock()
+		revoked := len(a.revoked)
+		a.lk.Unlock()
+		log.Printf("share: examined %d blobs, %d shares revoked, in %.1fs",
+			seen, revoked, float64(time.Nanoseconds()-start)/1e9)
+	}()
+	return blobserver.EnumerateAll(storage, func(sb *blobref.SizedBlobRef) {
+		if sb.Size <= schema.MaxSchemaBlobSize {
+			a.NoteBlob(sb.BlobRef)
+		}
+		if seen++; seen%loadProgressInterval == 0 {
+			log.Printf("share: looking for revocations, %d blobs examined", seen)
+		}
+	})
+}
+
+// checkSigner returns nil if sb's signature is valid and from a
+// trusted signer.
+func (a *Authorizer) checkSigner(sb *schema.Blob) os.Error {
+	signer := blobref.Parse(sb.StringField("camliSigner"))
+	if signer == nil || sb.StringField("camliSig") == "" {
+		return os.NewError("not signed")
+	}
+	trusted := false
+	for _, ts := range a.TrustedSigners {
+		if ts.String() == signer.String() {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return os.NewError(fmt.Sprintf("signer %s isn't trusted", signer))
+	}
+	if a.VerifySignature != nil {
+		if !a.VerifySignature(string(sb.Raw)) {
+			return os.NewError("bad signature")
+		}
+		return nil
+	}
+	vr := jsonsign.NewVerificationRequest(string(sb.Raw), a.Fetcher)
+	if !vr.Verify() {
+		return os.NewError(fmt.Sprintf("bad signature: %v", vr.Err))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package share
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testStore struct {
+	t       *testing.T
+	storage blobserver.Storage
+}
+
+func (ts *testStore) add(contents string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(contents))
+	ref := blobref.FromHash("sha1", s1)
+	if _, err := ts.storage.ReceiveBlob(ref, strings.NewReader(contents)); err != nil {
+		ts.t.Fatalf("ReceiveBlob: %v", err)
+	}
+	return ref
+}
+
+// share fakes a share signed by signer; fakeVerify accepts camliSig
+// "good" only.
+func (ts *testStore) share(target *blobref.BlobRef, transitive bool, signer *blobref.BlobRef, sig string) *blobref.BlobRef {
+	return ts.add(fmt.Sprintf(`{"camliVersion":1,"camliType":"share","authType":"haveref","target":%q,"transitive":%v,"camliSigner":%q,"camliSig":%q}`,
+		target.String(), transitive, signer.String(), sig))
+}
+
+func fakeVerify(sjson string) bool {
+	return strings.HasSuffix(sjson, `"camliSig":"good"}`)
+}
+
+func TestAuthorize(t *testing.T) {
+	ts := &testStore{t: t, storage: memory.New()}
+	trusted := ts.add("-----BEGIN PGP PUBLIC KEY BLOCK-----\ntrusted\n")
+	stranger := ts.add("-----BEGIN PGP PUBLIC KEY BLOCK-----\nstranger\n")
+
+	chunk := ts.add("chunk")
+	other := ts.add("not in the tree")
+	file := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "size": 5,
+  "contentParts": [{"blobRef": %q, "size": 5}]}`, chunk))
+	set := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "static-set", "members": [%q]}`, file))
+	dir := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "directory", "fileName": "d", "entries": %q}`, set))
+	// Mentions other, but not as a genuine reference.
+	mention := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "fileName": %q, "size": 0, "contentParts": []}`, other))
+
+	transitive := ts.share(dir, true, trusted, "good")
+	direct := ts.share(dir, false, trusted, "good")
+	forged := ts.share(dir, true, trusted, "bad")
+	untrusted := ts.share(dir, true, stranger, "good")
+	mentionShare := ts.share(mention, true, trusted, "good")
+	unsigned := ts.add(fmt.Sprintf(`{"camliVersion": 1, "camliType": "share", "authType": "haveref", "target": %q, "transitive": true}`, dir))
+
+	a := &Authorizer{Fetcher: ts.storage, TrustedSigners: []*blobref.BlobRef{trusted}, VerifySignature: fakeVerify}
+	tests := []struct {
+		name  string
+		chain []*blobref.BlobRef
+		ok    bool
+	}{
+		{"share itself", []*blobref.BlobRef{transitive}, true},
+		{"target", []*blobref.BlobRef{transitive, dir}, true},
+		{"whole path", []*blobref.BlobRef{transitive, dir, set, file, chunk}, true},
+		{"non-transitive target", []*blobref.BlobRef{direct, dir}, true},
+		{"non-transitive beyond target", []*blobref.BlobRef{direct, dir, set}, false},
+		{"skipped hop", []*blobref.BlobRef{transitive, dir, file}, false},
+		{"wrong target", []*blobref.BlobRef{transitive, set}, false},
+		{"not a share", []*blobref.BlobRef{dir, set}, false},
+		{"forged share", []*blobref.BlobRef{forged, dir}, false},
+		{"untrusted signer", []*blobref.BlobRef{untrusted, dir}, false},
+		{"unsigned share", []*blobref.BlobRef{unsigned, dir}, false},
+		{"mention isn't a reference", []*blobref.BlobRef{mentionShare, mention, other}, false},
+		{"missing hop", []*blobref.BlobRef{transitive, dir, blobref.Parse("sha1-deadbeefdeadbeefdeadbeefdeadbeefdeadbeef"), chunk}, false},
+	}
+	for _, tt := range tests {
+		err := a.Authorize(tt.chain)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: Authorize = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+
+	if err := (&Authorizer{Fetcher: ts.storage, VerifySignature: fakeVerify}).Authorize([]*blobref.BlobRef{transitive, dir}); err == nil {
+		t.Errorf("Authorize with no trusted signers succeeded")
+	}
+}
+
+func TestExpiryAndRevocation(t *testing.T) {
+	ts := &testStore{t: t, storage: memory.New()}
+	trusted := ts.add("-----BEGIN PGP PUBLIC KEY BLOCK-----\ntrusted\n")
+	stranger := ts.add("-----BEGIN PGP PUBLIC KEY BLOCK-----\nstranger\n")
+	target := ts.add("target")
+	withExpiry := func(expires string) *blobref.BlobRef {
+		return ts.add(fmt.Sprintf(`{"camliVersion":1,"camliType":"share","authType":"haveref","target":%q,"expires":%q,"camliSigner":%q,"camliSig":"good"}`,
+			target.String(), expires, trusted.String()))
+	}
+	revoke := func(share, signer *blobref.BlobRef, sig string) *blobref.BlobRef {
+		return ts.add(fmt.Sprintf(`{"camliVersion":1,"camliType":"claim","claimType":"share-revocation","target":%q,"camliSigner":%q,"camliSig":%q}`,
+			share.String(), signer.String(), sig))
+	}
+
+	a := &Authorizer{Fetcher: ts.storage, TrustedSigners: []*blobref.BlobRef{trusted}, VerifySignature: fakeVerify}
+	if err := a.Authorize([]*blobref.BlobRef{withExpiry("2999-01-01T00:00:00Z"), target}); err != nil {
+		t.Errorf("unexpired share: %v", err)
+	}
+	expired := withExpiry("2010-07-10T17:14:51Z")
+	if err, ok := a.Authorize([]*blobref.BlobRef{expired, target}).(*ExpiredError); !ok || err.Expires != 1278782091e9 {
+		t.Errorf("expired share: got %v; want an ExpiredError", err)
+	}
+	if err := a.Authorize([]*blobref.BlobRef{withExpiry("someday"), target}); err == nil {
+		t.Errorf("share with malformed expiry was honored")
+	}
+
+	share := ts.share(target, true, trusted, "good")
+	a.NoteBlob(revoke(share, stranger, "good"))
+	a.NoteBlob(revoke(share, trusted, "bad"))
+	if err := a.Authorize([]*blobref.BlobRef{share, target}); err != nil {
+		t.Errorf("share with only untrusted or forged revocations: %v", err)
+	}
+	claim := revoke(share, trusted, "good")
+	a.NoteBlob(claim)
+	if err, ok := a.Authorize([]*blobref.BlobRef{share, target}).(*RevokedError); !ok || err.Claim.String() != claim.String() {
+		t.Errorf("revoked share: got %v; want a RevokedError for %v", err, claim)
+	}
+
+	restarted := &Authorizer{Fetcher: ts.storage, TrustedSigners: []*blobref.BlobRef{trusted}, VerifySignature: fakeVerify}
+	if err := restarted.LoadRevocations(ts.storage); err != nil {
+		t.Fatalf("LoadRevocations: %v", err)
+	}
+	if _, ok := restarted.Authorize([]*blobref.BlobRef{share, target}).(*RevokedError); !ok {
+		t.Errorf("revocation not found by LoadRevocations")
+	}
+}
@@ -56,9 +56,15 @@ func (bb *ByCountAndBytes) String() string {
 	return fmt.Sprintf("[blobs=%d bytes=%d]", bb.Blobs, bb.Bytes)
 }
 
-func NewOrFail() *Client {
+// New returns a Client for the blob server at server, e.g.
+// "http://localhost:3179", authenticating with password.
+func New(server, password string) *Client {
 	log := log.New(os.Stderr, "", log.Ldate|log.Ltime)
-	return &Client{server: blobServerOrDie(), password: passwordOrDie(), log: log}
+	return &Client{server: cleanServer(server), password: password, log: log}
+}
+
+func NewOrFail() *Client {
+	return New(blobServerOrDie(), passwordOrDie())
 }
 
 type devNullWriter struct{}
@@ -113,6 +113,22 @@ func passwordOrDie() string {
 	return password
 }
 
+// HashName returns the hash function used to name new blobs, from
+// the "hashFunction" key in the config file.  It defaults to "sha1";
+// "sha224" and "sha256" are also supported.
+func HashName() string {
+	configOnce.Do(parseConfig)
+	value, ok := config["hashFunction"]
+	if !ok {
+		return "sha1"
+	}
+	hashName, _ := value.(string)
+	if blobref.NewHash(hashName) == nil {
+		log.Exitf("Unsupported \"hashFunction\" %#v in %q", value, ConfigFilePath())
+	}
+	return hashName
+}
+
 // Returns blobref of signer's public key, or nil if unconfigured.
 func (c *Client) SignerPublicKeyBlobref() *blobref.BlobRef {
 	configOnce.Do(parseConfig)
@@ -0,0 +1,91 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"camli/blobref"
+	"camli/http"
+	"fmt"
+	"os"
+)
+
+// EnumerateBlobs sends to dest up to limit of the server's blobs
+// sorting after after, following the server's "after" continuation
+// as needed.  It closes dest.
+func (c *Client) EnumerateBlobs(dest chan *blobref.SizedBlobRef, after string, limit uint) os.Error {
+	defer close(dest)
+	error := func(msg string, e os.Error) os.Error {
+		err := os.NewError(fmt.Sprintf("Error enumerating blobs: %s; err=%v", msg, e))
+		c.log.Print(err.String())
+		return err
+	}
+	for limit > 0 {
+		url := fmt.Sprintf("%s/camli/enumerate-blobs?after=%s&limit=%d",
+			c.server, http.URLEscape(after), limit)
+		req := http.NewGetRequest(url)
+		if c.HasAuthCredentials() {
+			req.Header["Authorization"] = c.authHeader()
+		}
+		resp, err := req.Send()
+		if err != nil {
+			return error("http error", err)
+		}
+		json, err := c.jsonFromResponse(resp)
+		if err != nil {
+			return error("json parse error", err)
+		}
+		blobs, ok := json["blobs"].([]interface{})
+		if !ok {
+			return error("response JSON missing 'blobs'", nil)
+		}
+		for _, b := range blobs {
+			sb, err := sizedBlobRefFromJson(b)
+			if err != nil {
+				return error("malformed 'blobs' entry", err)
+			}
+			dest <- sb
+			limit--
+			if limit == 0 {
+				return nil
+			}
+		}
+		if after, ok = json["after"].(string); !ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+// sizedBlobRefFromJson parses a JSON object like
+// {"blobRef": "sha1-...", "size": 123}, as used in the
+// enumerate-blobs and preupload responses.
+func sizedBlobRefFromJson(v interface{}) (*blobref.SizedBlobRef, os.Error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, os.NewError("not a JSON object")
+	}
+	refStr, _ := m["blobRef"].(string)
+	ref := blobref.Parse(refStr)
+	if ref == nil {
+		return nil, os.NewError(fmt.Sprintf("invalid blobRef %q", refStr))
+	}
+	size, ok := m["size"].(float64)
+	if !ok {
+		return nil, os.NewError(fmt.Sprintf("missing size for %s", ref))
+	}
+	return &blobref.SizedBlobRef{BlobRef: ref, Size: int64(size)}, nil
+}
@@ -45,29 +45,119 @@ func (c *Client) FetchVia(b *blobref.BlobRef, v []*blobref.BlobRef) (blobref.Rea
 	        url = buf.String()
 	}
 
-	req := http.NewGetRequest(url)
-
-	if c.HasAuthCredentials() {
-		req.Header["Authorization"] = c.authHeader()
-	}
-	resp, err := req.Send()
+	resp, err := c.sendGet(url, 0)
 	if err != nil {
 		return nil, 0, err
 	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, os.ENOENT
+	default:
+		resp.Body.Close()
+		return nil, 0, os.NewError(fmt.Sprintf("fetch of %s: HTTP status %d", b, resp.StatusCode))
+	}
 
 	var size int64
 	if s := resp.GetHeader("Content-Length"); s != "" {
 		size, _ = strconv.Atoi64(s)
 	}
 
-	return nopSeeker{resp.Body}, size, nil	
+	return &remoteBlob{c: c, blob: b, url: url, size: size, body: resp.Body}, size, nil
+}
+
+// sendGet fetches url, from byte offset start onwards.
+func (c *Client) sendGet(url string, start int64) (*http.Response, os.Error) {
+	req := http.NewGetRequest(url)
+	if c.HasAuthCredentials() {
+		req.Header["Authorization"] = c.authHeader()
+	}
+	if start > 0 {
+		req.Header["Range"] = fmt.Sprintf("bytes=%d-", start)
+	}
+	return req.Send()
+}
+
+// remoteBlob is a blob being read from a blobserver.  Seeking drops
+// the current response; the next Read then fetches the rest of the
+// blob from the new offset with a Range request.
+type remoteBlob struct {
+	c    *Client
+	blob *blobref.BlobRef
+	url  string
+	size int64
+	pos  int64
+	body io.ReadCloser // nil after a seek
+}
+
+func (rb *remoteBlob) Read(p []byte) (n int, err os.Error) {
+	if rb.pos >= rb.size {
+		return 0, os.EOF
+	}
+	if rb.body == nil {
+		if err := rb.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = rb.body.Read(p)
+	rb.pos += int64(n)
+	return
+}
+
+func (rb *remoteBlob) open() os.Error {
+	resp, err := rb.c.sendGet(rb.url, rb.pos)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the Range; skip to pos.
+		if _, err := io.Copyn(discard{}, resp.Body, rb.pos); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		resp.Body.Close()
+		return os.NewError(fmt.Sprintf("fetch of %s at offset %d: HTTP status %d", rb.blob, rb.pos, resp.StatusCode))
+	}
+	rb.body = resp.Body
+	return nil
 }
 
-type nopSeeker struct {
-	io.ReadCloser
+func (rb *remoteBlob) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += rb.pos
+	case 2:
+		offset += rb.size
+	default:
+		return rb.pos, os.EINVAL
+	}
+	if offset < 0 {
+		return rb.pos, os.EINVAL
+	}
+	if offset != rb.pos && rb.body != nil {
+		rb.body.Close()
+		rb.body = nil
+	}
+	rb.pos = offset
+	return offset, nil
 }
 
-func (n nopSeeker) Seek(offset int64, whence int) (ret int64, err os.Error) {
-	return 0, os.NewError("seek unsupported")
+func (rb *remoteBlob) Close() os.Error {
+	if rb.body == nil {
+		return nil
+	}
+	err := rb.body.Close()
+	rb.body = nil
+	return err
 }
 
+type discard struct{}
+
+func (discard) Write(p []byte) (int, os.Error) {
+	return len(p), nil
+}
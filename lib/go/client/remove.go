@@ -0,0 +1,67 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"camli/blobref"
+	"camli/http"
+	"fmt"
+	"os"
+)
+
+// RemoveBlobs asks the server to delete blobs.  It's not an error if
+// the server didn't have some of them.
+func (c *Client) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	error := func(msg string, e os.Error) os.Error {
+		err := os.NewError(fmt.Sprintf("Error removing blobs: %s; err=%v", msg, e))
+		c.log.Print(err.String())
+		return err
+	}
+	for len(blobs) > 0 {
+		batch := blobs
+		if len(batch) > maxBlobsPerRequest {
+			batch = batch[:maxBlobsPerRequest]
+		}
+		blobs = blobs[len(batch):]
+
+		body := bytes.NewBufferString("camliversion=1")
+		for i, blob := range batch {
+			fmt.Fprintf(body, "&blob%d=%s", i+1, blob)
+		}
+		req := http.NewPostRequest(
+			fmt.Sprintf("%s/camli/remove", c.server),
+			"application/x-www-form-urlencoded",
+			body)
+		req.Header["Authorization"] = c.authHeader()
+		req.ContentLength = int64(body.Len())
+		req.TransferEncoding = nil
+
+		resp, err := req.Send()
+		if err != nil {
+			return error("http error", err)
+		}
+		json, err := c.jsonFromResponse(resp)
+		if err != nil {
+			return error("json parse error", err)
+		}
+		if _, ok := json["removed"].([]interface{}); !ok {
+			return error("remove json validity error: no 'removed'", nil)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"camli/blobref"
+	"camli/http"
+	"fmt"
+	"os"
+)
+
+// maxBlobsPerRequest bounds how many blobs are named in one stat or
+// remove request.
+const maxBlobsPerRequest = 1000
+
+// Stat sends to dest the size of each of blobs the server has.  It
+// doesn't close dest.
+func (c *Client) Stat(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	for len(blobs) > 0 {
+		batch := blobs
+		if len(batch) > maxBlobsPerRequest {
+			batch = batch[:maxBlobsPerRequest]
+		}
+		blobs = blobs[len(batch):]
+		if err := c.statBatch(dest, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) statBatch(dest chan *blobref.SizedBlobRef, blobs []*blobref.BlobRef) os.Error {
+	error := func(msg string, e os.Error) os.Error {
+		err := os.NewError(fmt.Sprintf("Error statting blobs: %s; err=%v", msg, e))
+		c.log.Print(err.String())
+		return err
+	}
+
+	body := bytes.NewBufferString("camliversion=1")
+	for i, blob := range blobs {
+		fmt.Fprintf(body, "&blob%d=%s", i+1, blob)
+	}
+	req := http.NewPostRequest(
+		fmt.Sprintf("%s/camli/stat", c.server),
+		"application/x-www-form-urlencoded",
+		body)
+	req.Header["Authorization"] = c.authHeader()
+	req.ContentLength = int64(body.Len())
+	req.TransferEncoding = nil
+
+	resp, err := req.Send()
+	if err != nil {
+		return error("stat http error", err)
+	}
+	json, err := c.jsonFromResponse(resp)
+	if err != nil {
+		return error("stat json parse error", err)
+	}
+	stat, ok := json["stat"].([]interface{})
+	if !ok {
+		return error("stat json validity error: no 'stat'", nil)
+	}
+	for _, have := range stat {
+		sb, err := sizedBlobRefFromJson(have)
+		if err != nil {
+			return error("stat json validity error: malformed 'stat'", err)
+		}
+		dest <- sb
+	}
+	return nil
+}
@@ -20,7 +20,6 @@ import (
 	"bytes"
 	"camli/blobref"
 	"camli/http"
-	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -42,11 +41,14 @@ type PutResult struct {
 	Skipped  bool    // already present on blobserver
 }
 
+// NewUploadHandleFromString returns an UploadHandle for data, named
+// with the configured HashName.
 // Note: must not touch data after calling this.
 func NewUploadHandleFromString(data string) *UploadHandle {
-	s1 := sha1.New()
-	s1.Write([]byte(data))
-	bref := blobref.FromHash("sha1", s1)
+	hashName := HashName()
+	hash := blobref.NewHash(hashName)
+	hash.Write([]byte(data))
+	bref := blobref.FromHash(hashName, hash)
 	buf := bytes.NewBufferString(data)
 	return &UploadHandle{BlobRef: bref, Size: int64(len(data)), Contents: buf}
 }
@@ -134,11 +136,19 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 	// TODO: use a proper random boundary
 	boundary := "sdf8sd8f7s9df9s7df9sd7sdf9s879vs7d8v7sd8v7sd8v"
 
+	// If the server has the start of the blob from an earlier
+	// attempt, only send the rest.
+	partName := blobRefString
+	resumeKey, skip := c.resumePoint(h, pur)
+	if resumeKey != "" {
+		partName = resumeKey
+	}
+
 	multiPartHeader := fmt.Sprintf(
 		                "--%s\r\nContent-Type: application/octet-stream\r\n" +
 		                "Content-Disposition: form-data; name=\"%s\"; filename=\"%s\"\r\n\r\n",
 				boundary,
-				h.BlobRef, h.BlobRef)
+				partName, h.BlobRef)
 	multiPartFooter := "\r\n--"+boundary+"--\r\n"
 
 	c.log.Printf("Uploading to URL: %s", uploadUrl)
@@ -149,7 +159,7 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 			h.Contents,
 		        strings.NewReader(multiPartFooter)))
 	req.Header["Authorization"] = c.authHeader()
-	req.ContentLength = int64(len(multiPartHeader)) + h.Size + int64(len(multiPartFooter))
+	req.ContentLength = int64(len(multiPartHeader)) + h.Size - skip + int64(len(multiPartFooter))
 	req.TransferEncoding = nil
 	resp, err = req.Send()
 	if err != nil {
@@ -223,3 +233,49 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 
 	return nil, os.NewError("Server didn't receive blob.")
 }
+
+// resumePoint looks in a preupload response for a partial upload of h
+// whose digest matches the start of h's contents.  If it finds one,
+// h.Contents is left just past that part, and the part's resume key
+// and size are returned.  Otherwise h.Contents is left where it was.
+// Only seekable contents can be resumed.
+func (c *Client) resumePoint(h *UploadHandle, pur map[string]interface{}) (resumeKey string, skip int64) {
+	partials, _ := pur["alreadyHavePartially"].([]interface{})
+	seeker, ok := h.Contents.(io.Seeker)
+	if len(partials) == 0 || !ok {
+		return "", 0
+	}
+	start, err := seeker.Seek(0, 1)
+	if err != nil {
+		return "", 0
+	}
+	for _, partial := range partials {
+		m, ok := partial.(map[string]interface{})
+		if !ok || m["blobRef"] != h.BlobRef.String() {
+			continue
+		}
+		key, _ := m["resumeKey"].(string)
+		size, _ := m["size"].(float64)
+		partRefString, _ := m["partBlobRef"].(string)
+		partRef := blobref.Parse(partRefString)
+		if key == "" || size <= 0 || int64(size) > h.Size || partRef == nil {
+			continue
+		}
+		hash := partRef.Hash()
+		if hash == nil {
+			continue
+		}
+		if _, err := seeker.Seek(start, 0); err != nil {
+			return "", 0
+		}
+		// The server may have several partial uploads, some
+		// corrupt; only resume from one that matches.
+		n, err := io.Copyn(hash, h.Contents, int64(size))
+		if err == nil && n == int64(size) && partRef.HashMatches(hash) {
+			c.log.Printf("Resuming upload of %s after %d bytes", h.BlobRef, n)
+			return key, n
+		}
+	}
+	seeker.Seek(start, 0)
+	return "", 0
+}
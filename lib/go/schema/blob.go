@@ -0,0 +1,138 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"bytes"
+	"camli/blobref"
+	"fmt"
+	"io/ioutil"
+	"json"
+	"os"
+)
+
+// A Blob is a parsed schema blob.  Raw keeps its exact bytes, which
+// signature checks need.
+type Blob struct {
+	Raw []byte
+	Map map[string]interface{}
+}
+
+// A NotSchemaError is returned by FetchBlob and FetchMap for a blob
+// that exists but isn't a schema blob.
+type NotSchemaError struct {
+	Blob   *blobref.BlobRef
+	Reason string
+}
+
+func (e *NotSchemaError) String() string {
+	return fmt.Sprintf("blob %s isn't a schema blob: %s", e.Blob, e.Reason)
+}
+
+// FetchBlob fetches blob and parses it as a schema blob.
+func FetchBlob(fetcher blobref.Fetcher, blob *blobref.BlobRef) (*Blob, os.Error) {
+	file, size, err := fetcher.Fetch(blob)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if size > MaxSchemaBlobSize {
+		return nil, &NotSchemaError{blob, fmt.Sprintf("too large (%d bytes)", size)}
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	// See doc/schema/blob-magic.txt.
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, &NotSchemaError{blob, "not a JSON object"}
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, &NotSchemaError{blob, err.String()}
+	}
+	if _, ok := m["camliVersion"]; !ok {
+		return nil, &NotSchemaError{blob, NoCamliVersionError.String()}
+	}
+	return &Blob{Raw: data, Map: m}, nil
+}
+
+// Type returns b's camliType.
+func (b *Blob) Type() string {
+	return b.StringField("camliType")
+}
+
+// StringField returns the string value of key, or "" if it's missing
+// or not a string.
+func (b *Blob) StringField(key string) string {
+	s, _ := b.Map[key].(string)
+	return s
+}
+
+// ContentRefs returns the blobrefs holding b's contents: a file's
+// parts, a directory's entries set or a static-set's members.  Some
+// may not be valid blobrefs.
+func (b *Blob) ContentRefs() []string {
+	refs := make([]string, 0)
+	switch b.Type() {
+	case "file":
+		parts, _ := b.Map["contentParts"].([]interface{})
+		for _, p := range parts {
+			if part, ok := p.(map[string]interface{}); ok {
+				if ref, ok := part["blobRef"].(string); ok {
+					refs = append(refs, ref)
+				}
+			}
+		}
+	case "directory":
+		if entries := b.StringField("entries"); entries != "" {
+			refs = append(refs, entries)
+		}
+	case "static-set":
+		members, _ := b.Map["members"].([]interface{})
+		for _, m := range members {
+			if ref, ok := m.(string); ok {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// AllRefs returns every blobref b mentions: its ContentRefs, its
+// signer, a file's inode, the target of a share or keep and the
+// subjects of a claim.  Some may not be valid blobrefs.
+func (b *Blob) AllRefs() []string {
+	refs := b.ContentRefs()
+	add := func(key string) {
+		if ref := b.StringField(key); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	add("camliSigner")
+	switch b.Type() {
+	case "file":
+		add("inodeRef")
+	case "share", "keep":
+		add("target")
+	case "claim":
+		add("permaNode")
+		add("contents")
+		add("valueRef")
+	}
+	return refs
+}
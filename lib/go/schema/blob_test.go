@@ -0,0 +1,52 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"camli/blobserver/memory"
+	"fmt"
+	"testing"
+)
+
+func TestFetchBlob(t *testing.T) {
+	s := memory.New()
+	part := addBlob(t, s, "contents")
+	signer := addBlob(t, s, "-----BEGIN PGP PUBLIC KEY BLOCK-----\n")
+	file := addBlob(t, s, fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "inodeRef": "sha1-inode",
+		"contentParts": [{"blobRef": %q, "size": 8}], "camliSigner": %q}`, part, signer))
+
+	b, err := FetchBlob(s, file)
+	if err != nil {
+		t.Fatalf("FetchBlob: %v", err)
+	}
+	if b.Type() != "file" || string(b.Raw[:1]) != "{" {
+		t.Errorf("FetchBlob = type %q raw %q", b.Type(), b.Raw)
+	}
+	if got, want := fmt.Sprint(b.ContentRefs()), fmt.Sprint([]string{part.String()}); got != want {
+		t.Errorf("ContentRefs = %s; want %s", got, want)
+	}
+	if got, want := fmt.Sprint(b.AllRefs()), fmt.Sprint([]string{part.String(), signer.String(), "sha1-inode"}); got != want {
+		t.Errorf("AllRefs = %s; want %s", got, want)
+	}
+
+	for _, contents := range []string{"not json", `{"camliType": "file"}`, "{"} {
+		_, err := FetchBlob(s, addBlob(t, s, contents))
+		if _, ok := err.(*NotSchemaError); !ok {
+			t.Errorf("FetchBlob(%q) error = %v; want a NotSchemaError", contents, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"camli/blobref"
+	"fmt"
+	"io"
+	"os"
+)
+
+// MaxSchemaBlobSize is the largest blob FetchBlob will parse.
+const MaxSchemaBlobSize = 1 << 20
+
+// FetchMap fetches blob and parses it as a JSON schema map.
+func FetchMap(fetcher blobref.Fetcher, blob *blobref.BlobRef) (map[string]interface{}, os.Error) {
+	b, err := FetchBlob(fetcher, blob)
+	if err != nil {
+		return nil, err
+	}
+	return b.Map, nil
+}
+
+// FileNameOf returns the "fileName" of a file, directory or symlink
+// map, or its "fileNameBytes" if the name isn't UTF-8.
+func FileNameOf(m map[string]interface{}) string {
+	if name, ok := m["fileName"].(string); ok {
+		return name
+	}
+	return string(bytesField(m, "fileNameBytes"))
+}
+
+// SymlinkTargetOf returns the "symlinkTarget" of a symlink map, or
+// its "symlinkTargetBytes" if the target isn't UTF-8.
+func SymlinkTargetOf(m map[string]interface{}) string {
+	if target, ok := m["symlinkTarget"].(string); ok {
+		return target
+	}
+	return string(bytesField(m, "symlinkTargetBytes"))
+}
+
+// bytesField returns a field holding an array of byte values and
+// UTF-8 strings, such as "fileNameBytes".
+func bytesField(m map[string]interface{}, key string) []byte {
+	values, _ := m[key].([]interface{})
+	b := make([]byte, 0, len(values))
+	for _, v := range values {
+		switch v := v.(type) {
+		case float64:
+			b = append(b, byte(v))
+		case string:
+			b = append(b, []byte(v)...)
+		}
+	}
+	return b
+}
+
+// FileReader reads the contents of a "file" schema blob, fetching
+// and stitching together its contentParts.  Parts without a blobRef,
+// and any of the file's size beyond its parts, read as zeros.
+type FileReader struct {
+	fetcher blobref.Fetcher
+	size    int64
+	parts   []ContentPart
+
+	off int64 // position in the file
+
+	// The open blob of the last part read, and where in it.
+	cur     blobref.ReadSeekCloser
+	curBlob *blobref.BlobRef
+	curOff  int64
+}
+
+// NewFileReader returns a FileReader for the parsed "file" schema
+// map m.
+func NewFileReader(fetcher blobref.Fetcher, m map[string]interface{}) (*FileReader, os.Error) {
+	if t, _ := m["camliType"].(string); t != "file" {
+		return nil, os.NewError(fmt.Sprintf("schema blob has camliType %q, not \"file\"", t))
+	}
+	size, ok := m["size"].(float64)
+	if !ok || size < 0 {
+		return nil, os.NewError("file schema blob has no valid \"size\"")
+	}
+	fr := &FileReader{fetcher: fetcher, size: int64(size)}
+	mparts, _ := m["contentParts"].([]interface{})
+	for _, mp := range mparts {
+		mpart, ok := mp.(map[string]interface{})
+		if !ok {
+			return nil, os.NewError("malformed contentParts in file schema blob")
+		}
+		var part ContentPart
+		partSize, ok := mpart["size"].(float64)
+		if !ok || partSize < 0 {
+			return nil, os.NewError("contentParts element without valid \"size\"")
+		}
+		part.Size = int64(partSize)
+		if offset, ok := mpart["offset"].(float64); ok && offset > 0 {
+			part.Offset = int64(offset)
+		}
+		if ref, ok := mpart["blobRef"].(string); ok {
+			if part.BlobRef = blobref.Parse(ref); part.BlobRef == nil {
+				return nil, os.NewError(fmt.Sprintf("invalid blobRef %q in contentParts", ref))
+			}
+		}
+		if part.Size > 0 {
+			fr.parts = append(fr.parts, part)
+		}
+	}
+	return fr, nil
+}
+
+// Size returns the size of the file, which is canonical even if it
+// disagrees with the sum of the contentParts.
+func (fr *FileReader) Size() int64 {
+	return fr.size
+}
+
+// findPart returns the part holding the byte at off, and how far into
+// the part that is.  It returns nil past the last part.
+func (fr *FileReader) findPart(off int64) (part *ContentPart, partOff int64) {
+	start := int64(0)
+	for i := range fr.parts {
+		p := &fr.parts[i]
+		if off < start+p.Size {
+			return p, off - start
+		}
+		start += p.Size
+	}
+	return nil, 0
+}
+
+func (fr *FileReader) Read(p []byte) (n int, err os.Error) {
+	if fr.off >= fr.size {
+		return 0, os.EOF
+	}
+	if remain := fr.size - fr.off; int64(len(p)) > remain {
+		p = p[:remain]
+	}
+	part, partOff := fr.findPart(fr.off)
+	if part != nil {
+		if remain := part.Size - partOff; int64(len(p)) > remain {
+			p = p[:remain]
+		}
+	}
+	if part == nil || part.BlobRef == nil {
+		for i := range p {
+			p[i] = 0
+		}
+		n = len(p)
+	} else {
+		n, err = fr.readBlob(p, part.BlobRef, part.Offset+partOff)
+	}
+	fr.off += int64(n)
+	return n, err
+}
+
+// readBlob reads from blob at off, reusing the open blob if it can.
+func (fr *FileReader) readBlob(p []byte, blob *blobref.BlobRef, off int64) (n int, err os.Error) {
+	if fr.cur == nil || fr.curBlob.String() != blob.String() {
+		fr.closeCur()
+		if fr.cur, _, err = fr.fetcher.Fetch(blob); err != nil {
+			fr.cur = nil
+			return 0, err
+		}
+		fr.curBlob, fr.curOff = blob, 0
+	}
+	if fr.curOff != off {
+		if _, err = fr.cur.Seek(off, 0); err != nil {
+			return 0, err
+		}
+		fr.curOff = off
+	}
+	n, err = fr.cur.Read(p)
+	fr.curOff += int64(n)
+	if err == os.EOF {
+		if n > 0 {
+			err = nil
+		} else {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// Seek sets the offset of the next Read, as in io.Seeker.
+func (fr *FileReader) Seek(offset int64, whence int) (int64, os.Error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += fr.off
+	case 2:
+		offset += fr.size
+	default:
+		return fr.off, os.EINVAL
+	}
+	if offset < 0 {
+		return fr.off, os.EINVAL
+	}
+	fr.off = offset
+	return offset, nil
+}
+
+func (fr *FileReader) closeCur() {
+	if fr.cur != nil {
+		fr.cur.Close()
+		fr.cur = nil
+	}
+}
+
+// Close closes any blob the FileReader has open.
+func (fr *FileReader) Close() os.Error {
+	fr.closeCur()
+	return nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/memory"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"json"
+	"strings"
+	"testing"
+)
+
+func addBlob(t *testing.T, s blobserver.Storage, contents string) *blobref.BlobRef {
+	s1 := sha1.New()
+	s1.Write([]byte(contents))
+	blob := blobref.FromHash("sha1", s1)
+	if _, err := s.ReceiveBlob(blob, strings.NewReader(contents)); err != nil {
+		t.Fatalf("ReceiveBlob: %v", err)
+	}
+	return blob
+}
+
+func TestFileReader(t *testing.T) {
+	s := memory.New()
+	abc := addBlob(t, s, "abcdefghij")
+	xyz := addBlob(t, s, "xyz")
+	fileJson := fmt.Sprintf(`{"camliVersion": 1, "camliType": "file", "fileName": "f.txt", "size": 16,
+		"contentParts": [
+			{"blobRef": %q, "size": 3},
+			{"size": 2},
+			{"blobRef": %q, "size": 4, "offset": 5},
+			{"blobRef": %q, "size": 3}
+		]}`, abc, abc, xyz)
+	fileRef := addBlob(t, s, fileJson)
+
+	m, err := FetchMap(s, fileRef)
+	if err != nil {
+		t.Fatalf("FetchMap: %v", err)
+	}
+	if name := FileNameOf(m); name != "f.txt" {
+		t.Errorf("FileNameOf = %q; want f.txt", name)
+	}
+	fr, err := NewFileReader(s, m)
+	if err != nil {
+		t.Fatalf("NewFileReader: %v", err)
+	}
+	defer fr.Close()
+	// The parts sum to 12 bytes, but "size" is canonical, so the
+	// rest reads as zeros.
+	want := "abc\x00\x00fghixyz\x00\x00\x00\x00"
+	got, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("read %q; want %q", got, want)
+	}
+
+	for _, off := range []int64{0, 2, 4, 5, 8, 10, 15, 16} {
+		if _, err := fr.Seek(off, 0); err != nil {
+			t.Fatalf("Seek(%d): %v", off, err)
+		}
+		got, err := ioutil.ReadAll(fr)
+		if err != nil || string(got) != want[off:] {
+			t.Errorf("after Seek(%d), read %q, %v; want %q", off, got, err, want[off:])
+		}
+	}
+}
+
+func TestFileNameBytes(t *testing.T) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(`{"fileNameBytes": [102, 111, 234]}`), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if name := FileNameOf(m); name != "fo\xea" {
+		t.Errorf("FileNameOf = %q; want \"fo\\xea\"", name)
+	}
+	m = make(map[string]interface{})
+	if err := json.Unmarshal([]byte(`{"symlinkTargetBytes": ["../foo/Am", 233, "lie.jpg"]}`), &m); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if target := SymlinkTargetOf(m); target != "../foo/Am\xe9lie.jpg" {
+		t.Errorf("SymlinkTargetOf = %q; want \"../foo/Am\\xe9lie.jpg\"", target)
+	}
+}
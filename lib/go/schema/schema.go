@@ -20,7 +20,6 @@ import (
 	"bufio"
 	"bytes"
 	"camli/blobref"
-	"crypto/sha1"
 	"fmt"
 	"io"
 	"json"
@@ -40,26 +39,39 @@ type StatHasher interface {
 	Hash(fileName string) (*blobref.BlobRef, os.Error)
 }
 
-var DefaultStatHasher = &defaultStatHasher{}
+// DefaultStatHasher hashes files with sha1, the default hash
+// function.  Use NewStatHasher to follow a client's configured one.
+var DefaultStatHasher = &defaultStatHasher{"sha1"}
 
-type defaultStatHasher struct{}
+// NewStatHasher returns a StatHasher that hashes files with the named
+// hash function, such as "sha256".
+func NewStatHasher(hashName string) (StatHasher, os.Error) {
+	if blobref.NewHash(hashName) == nil {
+		return nil, os.NewError(fmt.Sprintf("unsupported hash function %q", hashName))
+	}
+	return &defaultStatHasher{hashName}, nil
+}
+
+type defaultStatHasher struct {
+	hashName string
+}
 
 func (d *defaultStatHasher) Lstat(fileName string) (*os.FileInfo, os.Error) {
 	return os.Lstat(fileName)
 }
 
 func (d *defaultStatHasher) Hash(fileName string) (*blobref.BlobRef, os.Error) {
-	s1 := sha1.New()
+	hash := blobref.NewHash(d.hashName)
 	file, err := os.Open(fileName, os.O_RDONLY, 0)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	_, err = io.Copy(s1, file)
+	_, err = io.Copy(hash, file)
         if err != nil {
                 return nil, err
         }
-	return blobref.FromHash("sha1", s1), nil
+	return blobref.FromHash(d.hashName, hash), nil
 }
 
 type StaticSet struct {
@@ -219,18 +231,52 @@ func PopulateDirectoryMap(m map[string]interface{}, staticSetRef *blobref.BlobRe
 	m["entries"] = staticSetRef.String()
 }
 
-func NewShareRef(authType string, target *blobref.BlobRef, transitive bool) map[string]interface{} {
+// NewShareRef returns an unsigned share of target.  If expires is
+// non-zero, the share stops granting access at that time, given in
+// nanoseconds since the epoch.
+func NewShareRef(authType string, target *blobref.BlobRef, transitive bool, expires int64) map[string]interface{} {
 	m := newCamliMap(1, "" /* no type yet */)
 	m["camliType"] = "share"
 	m["authType"] = authType
 	m["target"] = target.String()
 	m["transitive"] = transitive
+	if expires != 0 {
+		m["expires"] = rfc3339FromNanos(expires)
+	}
 	return m
 }
 
 // Types of ShareRefs
 const ShareHaveRef = "haveref"
 
+// ShareExpiresOf returns when a share map stops granting access, in
+// nanoseconds since the epoch, or 0 if it never expires.
+func ShareExpiresOf(m map[string]interface{}) (int64, os.Error) {
+	v, ok := m["expires"]
+	if !ok {
+		return 0, nil
+	}
+	s, _ := v.(string)
+	expires, err := nanosFromRFC3339(s)
+	if err != nil {
+		return 0, os.NewError(fmt.Sprintf("invalid share expiry %v", v))
+	}
+	return expires, nil
+}
+
+// The claimType of claims revoking a share.
+const ShareRevocationClaim = "share-revocation"
+
+// NewShareRevocationClaim returns an unsigned claim that revokes
+// share, so it no longer grants access to anything.
+func NewShareRevocationClaim(share *blobref.BlobRef) map[string]interface{} {
+	m := newCamliMap(1, "claim")
+	m["claimType"] = ShareRevocationClaim
+	m["claimDate"] = rfc3339FromNanos(time.Nanoseconds())
+	m["target"] = share.String()
+	return m
+}
+
 func rfc3339FromNanos(epochnanos int64) string {
 	nanos := epochnanos % 1e9
 	esec := epochnanos / 1e9
@@ -244,6 +290,51 @@ func rfc3339FromNanos(epochnanos int64) string {
 	return timeStr[:len(timeStr)-1] + "." + nanoStr + "Z"
 }
 
+// nanosFromRFC3339 parses a UTC time in the format written by
+// rfc3339FromNanos.
+func nanosFromRFC3339(s string) (int64, os.Error) {
+	nanos := int64(0)
+	if dot := strings.Index(s, "."); dot != -1 && strings.HasSuffix(s, "Z") {
+		frac := s[dot+1 : len(s)-1]
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		n, err := strconv.Atoi64(frac + strings.Repeat("0", 9-len(frac)))
+		if err != nil {
+			return 0, err
+		}
+		nanos = n
+		s = s[:dot] + "Z"
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Seconds()*1e9 + nanos, nil
+}
+
+// UnixMtimeOf returns the "unixMtime" of a file, directory or symlink
+// map in nanoseconds since the epoch, or 0 if it has none.
+func UnixMtimeOf(m map[string]interface{}) int64 {
+	s, _ := m["unixMtime"].(string)
+	nanos, err := nanosFromRFC3339(s)
+	if err != nil {
+		return 0
+	}
+	return nanos
+}
+
+// UnixPermissionOf returns the "unixPermission" of a file, directory
+// or symlink map, or def if it has none.
+func UnixPermissionOf(m map[string]interface{}, def uint32) uint32 {
+	s, _ := m["unixPermission"].(string)
+	perm, err := strconv.Btoui64(s, 8)
+	if err != nil {
+		return def
+	}
+	return uint32(perm)
+}
+
 func populateMap(m map[int]string, file string) {
 	f, err := os.Open(file, os.O_RDONLY, 0)
 	if err != nil {
@@ -17,6 +17,8 @@ limitations under the License.
 package schema
 
 import (
+	"camli/blobref"
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
@@ -102,4 +104,71 @@ func TestSymlink(t *testing.T) {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 	t.Logf("Got json for symlink file: [%s]\n", json)
-}
\ No newline at end of file
+}
+
+func TestRFC3339(t *testing.T) {
+	for _, nanos := range []int64{0, 1278782091e9, 1278782091e9 + 567800000, 1278782091e9 + 1} {
+		s := rfc3339FromNanos(nanos)
+		got, err := nanosFromRFC3339(s)
+		if err != nil || got != nanos {
+			t.Errorf("nanosFromRFC3339(%q) = %d, %v; want %d", s, got, err, nanos)
+		}
+	}
+	m := map[string]interface{}{"unixMtime": "2010-07-10T17:14:51.5678Z", "unixPermission": "0755"}
+	if got := UnixMtimeOf(m); got != 1278782091567800000 {
+		t.Errorf("UnixMtimeOf = %d", got)
+	}
+	if got := UnixPermissionOf(m, 0644); got != 0755 {
+		t.Errorf("UnixPermissionOf = %o; want 755", got)
+	}
+	if got := UnixPermissionOf(map[string]interface{}{}, 0644); got != 0644 {
+		t.Errorf("UnixPermissionOf with no permission = %o; want default 644", got)
+	}
+}
+
+func TestShareExpires(t *testing.T) {
+	target := blobref.Parse("sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33")
+	m := NewShareRef(ShareHaveRef, target, true, 1278782091e9)
+	if m["expires"] != "2010-07-10T17:14:51Z" {
+		t.Errorf("expires = %v", m["expires"])
+	}
+	if expires, err := ShareExpiresOf(m); err != nil || expires != 1278782091e9 {
+		t.Errorf("ShareExpiresOf = %d, %v", expires, err)
+	}
+	if expires, err := ShareExpiresOf(NewShareRef(ShareHaveRef, target, true, 0)); err != nil || expires != 0 {
+		t.Errorf("ShareExpiresOf of a share without expiry = %d, %v; want 0", expires, err)
+	}
+	if _, err := ShareExpiresOf(map[string]interface{}{"expires": "soon"}); err == nil {
+		t.Errorf("ShareExpiresOf accepted a malformed expiry")
+	}
+
+	claim := NewShareRevocationClaim(target)
+	if claim["camliType"] != "claim" || claim["claimType"] != ShareRevocationClaim || claim["target"] != target.String() {
+		t.Errorf("bad revocation claim %v", claim)
+	}
+}
+
+func TestStatHasher(t *testing.T) {
+	contents, err := ioutil.ReadFile("schema_test.go")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for _, hashName := range []string{"sha1", "sha256"} {
+		sh, err := NewStatHasher(hashName)
+		if err != nil {
+			t.Fatalf("NewStatHasher(%q): %v", hashName, err)
+		}
+		got, err := sh.Hash("schema_test.go")
+		if err != nil {
+			t.Fatalf("%s Hash: %v", hashName, err)
+		}
+		hash := blobref.NewHash(hashName)
+		hash.Write(contents)
+		if want := blobref.FromHash(hashName, hash); got.String() != want.String() {
+			t.Errorf("%s Hash = %s; want %s", hashName, got, want)
+		}
+	}
+	if _, err := NewStatHasher("md5"); err == nil {
+		t.Errorf("NewStatHasher accepted an unsupported hash")
+	}
+}
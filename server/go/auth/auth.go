@@ -17,54 +17,135 @@ limitations under the License.
 package auth
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"http"
+	"log"
 	"regexp"
 	"strings"
 )
 
 var kBasicAuthPattern *regexp.Regexp = regexp.MustCompile(`^Basic ([a-zA-Z0-9\+/=]+)`)
 
+// AccessPassword, if set, is accepted with any username, with
+// ScopeFull.  It's usually set from CAMLI_PASSWORD.
 var AccessPassword string
 
-func IsAuthorized(req *http.Request) bool {
+// A Scope is a set of things a credential allows.
+type Scope int
+
+const (
+	ScopeRead   Scope = 1 << iota // fetch, stat and enumerate blobs
+	ScopeUpload                   // upload blobs
+	ScopeRemove                   // remove blobs
+
+	// ScopeFull allows everything.
+	ScopeFull = ScopeRead | ScopeUpload | ScopeRemove
+)
+
+// Allows reports whether s includes everything in required.
+func (s Scope) Allows(required Scope) bool {
+	return s&required == required
+}
+
+func (s Scope) String() string {
+	switch s {
+	case ScopeRead:
+		return "read"
+	case ScopeUpload:
+		return "upload"
+	case ScopeRemove:
+		return "remove"
+	case ScopeFull:
+		return "full"
+	}
+	return fmt.Sprintf("Scope(%d)", int(s))
+}
+
+// basicAuth returns the username and password of req's HTTP Basic
+// Auth header, if it has one.
+func basicAuth(req *http.Request) (user, password string, ok bool) {
 	auth, present := req.Header["Authorization"]
 	if !present {
-		return false
+		return
 	}
 	matches := kBasicAuthPattern.FindStringSubmatch(auth)
 	if len(matches) != 2 {
-		return false
+		return
 	}
 	encoded := matches[1]
 	enc := base64.StdEncoding
 	decBuf := make([]byte, enc.DecodedLen(len(encoded)))
 	n, err := enc.Decode(decBuf, []byte(encoded))
 	if err != nil {
-		return false
+		return
 	}
 	userpass := strings.Split(string(decBuf[0:n]), ":", 2)
 	if len(userpass) != 2 {
-		fmt.Println("didn't get two pieces")
-		return false
+		return
 	}
-	password := userpass[1] // username at index 0 is currently unused
-	return password != "" && password == AccessPassword
+	return userpass[0], userpass[1], true
 }
 
-// requireAuth wraps a function with another function that enforces
-// HTTP Basic Auth.
-func RequireAuth(handler func(conn http.ResponseWriter, req *http.Request)) func (conn http.ResponseWriter, req *http.Request) {
-	return func (conn http.ResponseWriter, req *http.Request) {
-		if !IsAuthorized(req) {
-			req.Body.Close()  // http://code.google.com/p/go/issues/detail?id=1306
+// passwordsMatch compares the SHA-256 digests of a and b rather than
+// a and b themselves, so the time taken doesn't reveal their lengths.
+func passwordsMatch(a, b string) bool {
+	return subtle.ConstantTimeCompare(sha256Of(a), sha256Of(b)) == 1
+}
+
+func sha256Of(s string) []byte {
+	h := sha256.New()
+	h.Write([]byte(s))
+	return h.Sum()
+}
+
+// Authenticate returns the username from req's credentials and the
+// scope they grant.  The scope is 0 if the credentials are missing or
+// wrong.
+func Authenticate(req *http.Request) (user string, scope Scope) {
+	user, password, ok := basicAuth(req)
+	if !ok || password == "" {
+		return user, 0
+	}
+	if scope := users.scope(user, password); scope != 0 {
+		return user, scope
+	}
+	if AccessPassword != "" && passwordsMatch(password, AccessPassword) {
+		return user, ScopeFull
+	}
+	return user, 0
+}
+
+// IsAuthorized reports whether req has valid credentials allowing
+// scope.
+func IsAuthorized(req *http.Request, scope Scope) bool {
+	_, s := Authenticate(req)
+	return s != 0 && s.Allows(scope)
+}
+
+// RequireAuth wraps a function with another function that enforces
+// HTTP Basic Auth, letting through only credentials allowing scope.
+// Refused requests are logged with their username.
+func RequireAuth(scope Scope, handler func(conn http.ResponseWriter, req *http.Request)) func(conn http.ResponseWriter, req *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		user, s := Authenticate(req)
+		if s == 0 {
+			log.Printf("auth: denied %s %s for user %q: missing or bad credentials", req.Method, req.URL.Path, user)
+			req.Body.Close() // http://code.google.com/p/go/issues/detail?id=1306
 			conn.SetHeader("WWW-Authenticate", "Basic realm=\"camlistored\"")
 			conn.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprintf(conn, "Authentication required.\n")
 			return
 		}
+		if !s.Allows(scope) {
+			log.Printf("auth: denied %s %s for user %q: has %s scope, needs %s", req.Method, req.URL.Path, user, s, scope)
+			req.Body.Close()
+			conn.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(conn, "Credentials for %q don't allow %s access.\n", user, scope)
+			return
+		}
 		handler(conn, req)
 	}
 }
-
@@ -0,0 +1,127 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/base64"
+	"http"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func requestWithAuth(user, password string) *http.Request {
+	enc := base64.StdEncoding
+	userpass := []byte(user + ":" + password)
+	buf := make([]byte, enc.EncodedLen(len(userpass)))
+	enc.Encode(buf, userpass)
+	return &http.Request{Header: map[string]string{"Authorization": "Basic " + string(buf)}}
+}
+
+func writeUsersFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "camli-users-test")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(contents); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	return file.Name()
+}
+
+func TestUsers(t *testing.T) {
+	AccessPassword = ""
+	defer func() { users.creds = nil }()
+	fileName := writeUsersFile(t, `{"users": {
+		"alice": [{"token": "alice-token", "scope": "full"}],
+		"reader": [{"token": "reader-token", "scope": "read"}],
+		"janitor": [{"token": "janitor-token", "scope": "remove"}],
+		"phone": [{"token": "new-token", "scope": "upload"}, {"token": "old-token", "scope": "upload"}]
+	}}`)
+	defer os.Remove(fileName)
+	if err := LoadUsers(fileName); err != nil {
+		t.Fatalf("LoadUsers: %v", err)
+	}
+
+	tests := []struct {
+		user, password string
+		scope          Scope
+	}{
+		{"alice", "alice-token", ScopeFull},
+		{"reader", "reader-token", ScopeRead},
+		{"janitor", "janitor-token", ScopeRemove},
+		{"phone", "new-token", ScopeUpload},
+		{"phone", "old-token", ScopeUpload},
+		{"phone", "alice-token", 0},
+		{"mallory", "alice-token", 0},
+		{"alice", "", 0},
+		{"alice", "alice-token-", 0},
+		{"alice", "alice-toke", 0},
+	}
+	for _, tt := range tests {
+		user, scope := Authenticate(requestWithAuth(tt.user, tt.password))
+		if user != tt.user || scope != tt.scope {
+			t.Errorf("Authenticate(%q, %q) = %q, %v; want %v", tt.user, tt.password, user, scope, tt.scope)
+		}
+	}
+	if _, scope := Authenticate(&http.Request{Header: map[string]string{}}); scope != 0 {
+		t.Errorf("Authenticate without credentials = %v; want 0", scope)
+	}
+
+	AccessPassword = "legacy"
+	defer func() { AccessPassword = "" }()
+	if !IsAuthorized(requestWithAuth("anyone", "legacy"), ScopeFull) {
+		t.Errorf("AccessPassword wasn't accepted with full scope")
+	}
+	if IsAuthorized(requestWithAuth("phone", "new-token"), ScopeRead) {
+		t.Errorf("upload-only token was allowed to read")
+	}
+	if !IsAuthorized(requestWithAuth("alice", "alice-token"), ScopeUpload) {
+		t.Errorf("full token wasn't allowed to upload")
+	}
+	if !IsAuthorized(requestWithAuth("alice", "alice-token"), ScopeRemove) {
+		t.Errorf("full token wasn't allowed to remove")
+	}
+	if IsAuthorized(requestWithAuth("phone", "new-token"), ScopeRemove) {
+		t.Errorf("upload-only token was allowed to remove")
+	}
+	if IsAuthorized(requestWithAuth("janitor", "janitor-token"), ScopeUpload) {
+		t.Errorf("remove-only token was allowed to upload")
+	}
+
+	// Rotation: the old token is dropped, and a bad file changes
+	// nothing.
+	if err := ioutil.WriteFile(fileName, []byte(`{"users": {"phone": [{"token": "new-token", "scope": "upload"}]}}`), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := LoadUsers(fileName); err != nil {
+		t.Fatalf("LoadUsers after rotation: %v", err)
+	}
+	if _, scope := Authenticate(requestWithAuth("phone", "old-token")); scope != 0 {
+		t.Errorf("rotated-out token still has scope %v", scope)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(`{"users": {"phone": [{"token": "x", "scope": "admin"}]}}`), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := LoadUsers(fileName); err == nil {
+		t.Errorf("LoadUsers accepted an unknown scope")
+	}
+	if _, scope := Authenticate(requestWithAuth("phone", "new-token")); scope != ScopeUpload {
+		t.Errorf("after a bad reload, phone's scope = %v; want upload", scope)
+	}
+}
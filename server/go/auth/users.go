@@ -0,0 +1,150 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseScope parses a scope name from a users file: "read", "upload",
+// "remove" or "full".
+func ParseScope(name string) (Scope, os.Error) {
+	switch name {
+	case "read":
+		return ScopeRead, nil
+	case "upload":
+		return ScopeUpload, nil
+	case "remove":
+		return ScopeRemove, nil
+	case "full":
+		return ScopeFull, nil
+	}
+	return 0, os.NewError(fmt.Sprintf("unknown scope %q", name))
+}
+
+type credential struct {
+	token string
+	scope Scope
+}
+
+// userSet holds the credentials loaded from a users file.
+type userSet struct {
+	lk    sync.Mutex
+	creds map[string][]credential // by username
+}
+
+var users = new(userSet)
+
+// scope returns the scope of the user's credential with token
+// password, or 0 if there's none.
+func (us *userSet) scope(user, password string) Scope {
+	us.lk.Lock()
+	defer us.lk.Unlock()
+	for _, c := range us.creds[user] {
+		if passwordsMatch(password, c.token) {
+			return c.scope
+		}
+	}
+	return 0
+}
+
+// usersFile is the JSON users file format:
+//
+//	{"users": {
+//	   "alice": [{"token": "alice's token", "scope": "full"}],
+//	   "phone": [{"token": "new token", "scope": "upload"},
+//	             {"token": "old token", "scope": "upload"}]
+//	}}
+//
+// A user may have several tokens, each with its own scope, so a token
+// can be rotated by adding its replacement, updating clients, then
+// removing it.
+type usersFile struct {
+	Users map[string][]struct {
+		Token string
+		Scope string
+	}
+}
+
+// LoadUsers replaces the current credentials with those in the JSON
+// users file fileName.  On error, the current credentials are kept.
+func LoadUsers(fileName string) os.Error {
+	f, err := os.Open(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var uf usersFile
+	if err := json.NewDecoder(f).Decode(&uf); err != nil {
+		return os.NewError(fmt.Sprintf("Error parsing JSON in users file %q: %v", fileName, err))
+	}
+	creds := make(map[string][]credential)
+	for user, tokens := range uf.Users {
+		if user == "" || strings.Index(user, ":") != -1 {
+			return os.NewError(fmt.Sprintf("Invalid username %q in users file %q", user, fileName))
+		}
+		for _, t := range tokens {
+			if t.Token == "" {
+				return os.NewError(fmt.Sprintf("Empty token for user %q in users file %q", user, fileName))
+			}
+			scope, err := ParseScope(t.Scope)
+			if err != nil {
+				return os.NewError(fmt.Sprintf("Bad scope for user %q in users file %q: %v", user, fileName, err))
+			}
+			creds[user] = append(creds[user], credential{t.Token, scope})
+		}
+	}
+	users.lk.Lock()
+	defer users.lk.Unlock()
+	users.creds = creds
+	return nil
+}
+
+// WatchUsers reloads the users file fileName whenever its
+// modification time changes, checking every intervalNs nanoseconds.
+// It never returns.  Errors are logged, and the previous credentials
+// kept.
+func WatchUsers(fileName string, intervalNs int64) {
+	var lastMtime int64
+	if fi, err := os.Stat(fileName); err == nil {
+		lastMtime = fi.Mtime_ns
+	}
+	for {
+		time.Sleep(intervalNs)
+		fi, err := os.Stat(fileName)
+		if err != nil {
+			log.Printf("auth: can't stat users file: %v", err)
+			continue
+		}
+		if fi.Mtime_ns == lastMtime {
+			continue
+		}
+		// A file caught half-written is retried next time.
+		if err := LoadUsers(fileName); err != nil {
+			log.Printf("auth: keeping previous credentials: %v", err)
+			continue
+		}
+		lastMtime = fi.Mtime_ns
+		log.Printf("auth: reloaded users file %s", fileName)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"camli/blobref"
+	"camli/httputil"
+	"camli/schema"
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"strings"
+)
+
+const archivePrefix = "/camli/archive/"
+
+// maxArchiveDepth bounds how deeply nested a directory tree may be
+// before handleArchive gives up on it.
+const maxArchiveDepth = 256
+
+func createArchiveHandler(fetcher blobref.Fetcher) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleArchive(conn, req, fetcher)
+	}
+}
+
+// handleArchive streams a tar archive of the tree rooted at a
+// "directory" schema blob, for requests of the form
+// /camli/archive/<directory blobref>[?format=tar].
+func handleArchive(conn http.ResponseWriter, req *http.Request, fetcher blobref.Fetcher) {
+	dirRef := blobref.Parse(req.URL.Path[len(archivePrefix):])
+	if dirRef == nil {
+		httputil.BadRequestError(conn, "Malformed archive URL.")
+		return
+	}
+	req.ParseForm()
+	if format := req.FormValue("format"); format != "" && format != "tar" {
+		httputil.BadRequestError(conn, fmt.Sprintf("Unsupported archive format %q.", format))
+		return
+	}
+
+	m, err := schema.FetchMap(fetcher, dirRef)
+	if err == os.ENOENT {
+		conn.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(conn, "Object not found.")
+		return
+	}
+	if err != nil {
+		httputil.BadRequestError(conn, err.String())
+		return
+	}
+	if m["camliType"] != "directory" {
+		httputil.BadRequestError(conn, "Blob is not a directory.")
+		return
+	}
+
+	name := schema.FileNameOf(m)
+	if !validEntryName(name) {
+		name = dirRef.String()
+	}
+	conn.SetHeader("Content-Type", "application/x-tar")
+	conn.SetHeader("Content-Disposition", contentDisposition(name+".tar"))
+	if req.Method == "HEAD" {
+		conn.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Once the first entry is written the status can't change, so
+	// errors from here on cut the archive short instead.
+	tw := tar.NewWriter(conn)
+	if err := writeTarEntry(tw, fetcher, m, name, 0); err != nil {
+		fmt.Fprintf(os.Stderr, "Error archiving directory %v: %v\n", dirRef, err)
+		killConnection(conn)
+		return
+	}
+	if err := tw.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error archiving directory %v: %v\n", dirRef, err)
+		killConnection(conn)
+	}
+}
+
+// validEntryName reports whether name is usable as a single path
+// component of an archive entry.
+func validEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." && strings.IndexAny(name, "/\x00") == -1
+}
+
+// tarNameSize is the size of the name and link target fields of a
+// tar header.
+const tarNameSize = 100
+
+// tarUserNameSize is the size of the owner and group name fields of
+// a tar header.
+const tarUserNameSize = 32
+
+// GNU tar type flags for a pseudo-entry whose contents are the name,
+// or the link target, of the next entry, when it doesn't fit in the
+// header.
+const (
+	gnuLongName = 'L'
+	gnuLongLink = 'K'
+)
+
+// writeTarHeader writes hdr to tw, preceded by GNU "././@LongLink"
+// entries for a name or link target too long for the header.  Owner
+// and group names too long for the header are left out, rather than
+// cut short into some other user's name; the numeric ids remain.
+func writeTarHeader(tw *tar.Writer, hdr *tar.Header) os.Error {
+	if len(hdr.Uname) >= tarUserNameSize {
+		hdr.Uname = ""
+	}
+	if len(hdr.Gname) >= tarUserNameSize {
+		hdr.Gname = ""
+	}
+	if len(hdr.Linkname) > tarNameSize {
+		if err := writeGNULongEntry(tw, gnuLongLink, hdr.Linkname); err != nil {
+			return err
+		}
+		hdr.Linkname = hdr.Linkname[:tarNameSize]
+	}
+	if len(hdr.Name) > tarNameSize {
+		if err := writeGNULongEntry(tw, gnuLongName, hdr.Name); err != nil {
+			return err
+		}
+		hdr.Name = hdr.Name[:tarNameSize]
+	}
+	return tw.WriteHeader(hdr)
+}
+
+func writeGNULongEntry(tw *tar.Writer, typeflag byte, value string) os.Error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     "././@LongLink",
+		Typeflag: typeflag,
+		Mode:     0644,
+		Size:     int64(len(value) + 1),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(tw, value+"\x00")
+	return err
+}
+
+// writeTarEntry writes the file, symlink or directory described by
+// the schema map m to tw as entryPath, recursing into directories.
+// File contents are copied as their parts are fetched.
+func writeTarEntry(tw *tar.Writer, fetcher blobref.Fetcher, m map[string]interface{}, entryPath string, depth int) os.Error {
+	hdr := &tar.Header{
+		Name:  entryPath,
+		Mtime: schema.UnixMtimeOf(m) / 1e9,
+	}
+	if uid, ok := m["unixOwnerId"].(float64); ok {
+		hdr.Uid = int(uid)
+	}
+	if gid, ok := m["unixGroupId"].(float64); ok {
+		hdr.Gid = int(gid)
+	}
+	hdr.Uname, _ = m["unixOwner"].(string)
+	hdr.Gname, _ = m["unixGroup"].(string)
+
+	switch m["camliType"] {
+	case "file":
+		fr, err := schema.NewFileReader(fetcher, m)
+		if err != nil {
+			return err
+		}
+		defer fr.Close()
+		hdr.Typeflag = tar.TypeReg
+		hdr.Mode = int64(schema.UnixPermissionOf(m, 0644))
+		hdr.Size = fr.Size()
+		if err := writeTarHeader(tw, hdr); err != nil {
+			return err
+		}
+		n, err := io.Copy(tw, fr)
+		if err == nil && n != hdr.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Mode = int64(schema.UnixPermissionOf(m, 0777))
+		hdr.Linkname = schema.SymlinkTargetOf(m)
+		return writeTarHeader(tw, hdr)
+	case "directory":
+		if depth >= maxArchiveDepth {
+			return os.NewError(fmt.Sprintf("directory %s is nested too deeply", entryPath))
+		}
+		hdr.Typeflag = tar.TypeDir
+		hdr.Mode = int64(schema.UnixPermissionOf(m, 0755))
+		hdr.Name = entryPath + "/"
+		if err := writeTarHeader(tw, hdr); err != nil {
+			return err
+		}
+		entriesString, _ := m["entries"].(string)
+		entriesRef := blobref.Parse(entriesString)
+		if entriesRef == nil {
+			return os.NewError(fmt.Sprintf("directory %s has no valid entries", entryPath))
+		}
+		set, err := schema.FetchMap(fetcher, entriesRef)
+		if err != nil {
+			return err
+		}
+		members, _ := set["members"].([]interface{})
+		for _, member := range members {
+			memberString, _ := member.(string)
+			memberRef := blobref.Parse(memberString)
+			if memberRef == nil {
+				return os.NewError(fmt.Sprintf("directory %s has an invalid member %q", entryPath, memberString))
+			}
+			child, err := schema.FetchMap(fetcher, memberRef)
+			if err != nil {
+				return err
+			}
+			name := schema.FileNameOf(child)
+			if !validEntryName(name) {
+				fmt.Fprintf(os.Stderr, "Skipping %v in archive of %s: bad name %q\n", memberRef, entryPath, name)
+				continue
+			}
+			if err := writeTarEntry(tw, fetcher, child, entryPath+"/"+name, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Skipping %s in archive: unsupported camliType %v\n", entryPath, m["camliType"])
+	return nil
+}
@@ -6,20 +6,52 @@ package main
 
 import (
 	"camli/auth"
+	"camli/blobref"
+	"camli/blobserver"
+	_ "camli/blobserver/cond"
+	_ "camli/blobserver/encrypt"
+	"camli/blobserver/localdisk"
+	"camli/blobserver/memory"
+	"camli/blobserver/packed"
+	_ "camli/blobserver/remote"
+	_ "camli/blobserver/s3"
+	"camli/blobserver/share"
 	"camli/httputil"
 	"camli/webserver"
-	"camli/blobref"
 	"flag"
 	"fmt"
 	"http"
+	"json"
 	"log"
 	"os"
+	"strings"
 )
 
-var flagStorageRoot *string = flag.String("root", "/tmp/camliroot", "Root directory to store files")
+var flagStorageRoot *string = flag.String("root", "/tmp/camliroot", "Root directory to store files, or \":memory:\" to keep blobs in memory only")
+var flagStorageType *string = flag.String("storage", "localdisk",
+	"Storage layout under -root: \"localdisk\" (one file per blob) or \"packed\" (append-only pack files)")
+var flagCompress *bool = flag.Bool("compress", false,
+	"With -storage=localdisk, store blobs gzipped when that saves space")
+var flagStorageConfig *string = flag.String("storageconfig", "",
+	"Optional JSON file describing the storage backend, e.g. {\"type\": \"s3\", ...}; overrides -root and -storage")
+var flagAllowRemove *bool = flag.Bool("allowremove", false, "Allow blobs to be deleted via /camli/remove, as GC and privacy tools need")
+var flagGC *bool = flag.Bool("gc", false, "Instead of serving, garbage collect blobs unreachable from signed permanodes and keep claims, then exit")
+var flagGCDryRun *bool = flag.Bool("gcdryrun", false, "With -gc, only report unreachable blobs; don't remove them")
+var flagGCGrace *int64 = flag.Int64("gcgrace", 3600, "With -gc, how many seconds ago an unreachable blob must have been stored to be removed; newer blobs are kept along with what they refer to")
+var flagFsck *bool = flag.Bool("fsck", false, "Instead of serving, re-hash every blob under the localdisk -root, quarantine corrupt ones, print a JSON report and exit (non-zero if any were bad)")
+var flagQuarantine *string = flag.String("quarantine", "", "With -fsck, directory to move corrupt blobs into; defaults to -root plus \"-quarantine\"")
+var flagMaxUploadSize *int64 = flag.Int64("maxuploadsize", 2147483647, "Largest blob, in bytes, that may be uploaded")
+var flagQuota *int64 = flag.Int64("quota", 0, "If non-zero, stop accepting new blobs once storage holds this many bytes")
+var flagShareSigners *string = flag.String("sharesigners", "", "Comma-separated blobrefs of the public keys whose signed shares grant access to blobs")
+var flagUserConfig *string = flag.String("userconfig", "",
+	"Optional JSON file of usernames and their scoped tokens; reloaded when it changes.  CAMLI_PASSWORD, if set, is also accepted with full access")
 var flagRequestLog *bool = flag.Bool("reqlog", false, "Log incoming requests")
 
-var blobFetcher blobref.Fetcher
+var storage blobserver.Storage
+
+// usersCheckInterval is how often, in nanoseconds, the -userconfig
+// file is checked for changes.
+const usersCheckInterval = 10e9
 
 func handleCamli(conn http.ResponseWriter, req *http.Request) {
 	handler := func(conn http.ResponseWriter, req *http.Request) {
@@ -31,26 +63,38 @@ func handleCamli(conn http.ResponseWriter, req *http.Request) {
 		log.Printf("%s %s", req.Method, req.RawURL)
 	}
 	switch req.Method {
-	case "GET":
-		switch req.URL.Path {
-		case "/camli/enumerate-blobs":
-			handler = auth.RequireAuth(handleEnumerateBlobs)
+	case "GET", "HEAD":
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/camli/enumerate-blobs":
+			handler = auth.RequireAuth(auth.ScopeRead, createEnumerateHandler(storage))
+		case req.Method == "GET" && req.URL.Path == "/camli/stat":
+			handler = auth.RequireAuth(auth.ScopeRead, createStatHandler(storage))
+		case strings.HasPrefix(req.URL.Path, archivePrefix):
+			handler = auth.RequireAuth(auth.ScopeRead, createArchiveHandler(storage))
+		case strings.HasPrefix(req.URL.Path, downloadPrefix):
+			handler = auth.RequireAuth(auth.ScopeRead, createDownloadHandler(storage))
+		case strings.HasPrefix(req.URL.Path, thumbnailPrefix):
+			handler = auth.RequireAuth(auth.ScopeRead, createThumbnailHandler(storage))
 		default:
-			handler = createGetHandler(blobFetcher)
+			handler = createGetHandler(storage)
 		}
 	case "POST":
 		switch req.URL.Path {
+		case "/camli/stat":
+			handler = auth.RequireAuth(auth.ScopeRead, createStatHandler(storage))
 		case "/camli/preupload":
-			handler = auth.RequireAuth(handlePreUpload)
+			handler = auth.RequireAuth(auth.ScopeUpload, createPreUploadHandler(storage))
 		case "/camli/upload":
-			handler = auth.RequireAuth(handleMultiPartUpload)
+			handler = auth.RequireAuth(auth.ScopeUpload, createUploadHandler(storage))
+		case "/camli/remove":
+			handler = auth.RequireAuth(auth.ScopeRemove, createRemoveHandler(storage))
 		case "/camli/testform": // debug only
 			handler = handleTestForm
 		case "/camli/form": // debug only
 			handler = handleCamliForm
 		}
 	case "PUT": // no longer part of spec
-		handler = auth.RequireAuth(handlePut)
+		handler = auth.RequireAuth(auth.ScopeUpload, createPutHandler(storage))
 	}
 	handler(conn, req)
 }
@@ -59,27 +103,100 @@ func handleRoot(conn http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(conn, "This is camlistored, a Camlistore storage daemon.\n")
 }
 
+func storageFromConfigFile(fileName string) (blobserver.Storage, os.Error) {
+	f, err := os.Open(fileName, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config := make(map[string]interface{})
+	if err = json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, os.NewError(fmt.Sprintf("Error parsing JSON in storage config %q: %v", fileName, err))
+	}
+	return blobserver.CreateStorage(config)
+}
+
 func main() {
 	flag.Parse()
 
+	// -fsck works on the storage root directly, without serving, so
+	// it needs no passwords.
+	if *flagFsck {
+		runFsck()
+		return
+	}
+
+	var err os.Error
+	switch {
+	case *flagStorageConfig != "":
+		storage, err = storageFromConfigFile(*flagStorageConfig)
+	case *flagStorageRoot == ":memory:":
+		storage = memory.New()
+	case *flagStorageType == "localdisk" && *flagCompress:
+		storage, err = localdisk.NewCompressed(*flagStorageRoot)
+	case *flagStorageType == "localdisk":
+		storage, err = localdisk.New(*flagStorageRoot)
+	case *flagStorageType == "packed":
+		storage, err = packed.New(*flagStorageRoot)
+	default:
+		err = os.NewError(fmt.Sprintf("Unknown -storage type %q", *flagStorageType))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	// Like -fsck, -gc doesn't serve, so it needs no passwords.
+	if *flagGC {
+		runGC()
+		return
+	}
+
 	auth.AccessPassword = os.Getenv("CAMLI_PASSWORD")
-	if len(auth.AccessPassword) == 0 {
+	if *flagUserConfig != "" {
+		if err := auth.LoadUsers(*flagUserConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		go auth.WatchUsers(*flagUserConfig, usersCheckInterval)
+	} else if len(auth.AccessPassword) == 0 {
 		fmt.Fprintf(os.Stderr,
-			"No CAMLI_PASSWORD environment variable set.\n")
+			"No CAMLI_PASSWORD environment variable or -userconfig set.\n")
 		os.Exit(1)
 	}
 
-	{
-		fi, err := os.Stat(*flagStorageRoot)
-		if err != nil || !fi.IsDirectory() {
-			fmt.Fprintf(os.Stderr,
-				"Storage root '%s' doesn't exist or is not a directory.\n",
-				*flagStorageRoot)
+	if *flagQuota > 0 {
+		if quota, err = newQuotaTracker(storage, *flagQuota); err != nil {
+			fmt.Fprintf(os.Stderr, "Error computing storage size for -quota: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
-	blobFetcher = newDiskStorage(*flagStorageRoot)
+	shares = &share.Authorizer{Fetcher: storage}
+	if *flagShareSigners != "" {
+		for _, s := range strings.Split(*flagShareSigners, ",", -1) {
+			signer := blobref.Parse(strings.TrimSpace(s))
+			if signer == nil {
+				fmt.Fprintf(os.Stderr, "Malformed blobref %q in -sharesigners\n", s)
+				os.Exit(1)
+			}
+			shares.TrustedSigners = append(shares.TrustedSigners, signer)
+		}
+		shares.Watch(blobserver.GetHub(storage))
+		if err := shares.LoadRevocations(storage); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading share revocations: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Only now, about to serve, is nothing else writing to storage,
+	// so any temp files are from writes interrupted by a crash.
+	if sweeper, ok := storage.(blobserver.TempFileSweeper); ok {
+		if _, err := sweeper.SweepTempFiles(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error sweeping temp files: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	ws := webserver.New()
 	ws.HandleFunc("/", handleRoot)
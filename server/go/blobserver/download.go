@@ -0,0 +1,152 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"camli/blobref"
+	"camli/httputil"
+	"camli/schema"
+	"fmt"
+	"http"
+	"mime"
+	"os"
+	"path"
+	"strings"
+)
+
+const downloadPrefix = "/camli/download/"
+
+func createDownloadHandler(fetcher blobref.Fetcher) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleDownload(conn, req, fetcher)
+	}
+}
+
+// handleDownload serves the contents of a "file" schema blob, for
+// requests of the form /camli/download/<file blobref>[/<name>].
+func handleDownload(conn http.ResponseWriter, req *http.Request, fetcher blobref.Fetcher) {
+	refAndName := req.URL.Path[len(downloadPrefix):]
+	refString, urlName := refAndName, ""
+	if slash := strings.Index(refAndName, "/"); slash != -1 {
+		refString, urlName = refAndName[:slash], refAndName[slash+1:]
+	}
+	fileRef := blobref.Parse(refString)
+	if fileRef == nil {
+		httputil.BadRequestError(conn, "Malformed download URL.")
+		return
+	}
+
+	m, err := schema.FetchMap(fetcher, fileRef)
+	if err == os.ENOENT {
+		conn.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(conn, "Object not found.")
+		return
+	}
+	if err != nil {
+		httputil.BadRequestError(conn, err.String())
+		return
+	}
+	fr, err := schema.NewFileReader(fetcher, m)
+	if err != nil {
+		httputil.BadRequestError(conn, err.String())
+		return
+	}
+	defer fr.Close()
+	size := fr.Size()
+
+	name := schema.FileNameOf(m)
+	if name == "" {
+		name = urlName
+	}
+	if name == "" {
+		name = fileRef.String()
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// A file blob, like any other, never changes.
+	etag := fmt.Sprintf("%q", fileRef.String())
+	conn.SetHeader("ETag", etag)
+	conn.SetHeader("Cache-Control", fmt.Sprintf("private, max-age=%d", blobMaxAgeSeconds))
+	conn.SetHeader("Accept-Ranges", "bytes")
+	conn.SetHeader("Content-Disposition", contentDisposition(name))
+	if etagMatches(req.Header["If-None-Match"], etag) {
+		conn.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	ranges, err := parseRange(req.Header["Range"], size)
+	if err != nil {
+		conn.SetHeader("Content-Range", fmt.Sprintf("bytes */%d", size))
+		conn.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	switch len(ranges) {
+	case 0:
+		conn.SetHeader("Content-Type", contentType)
+		conn.SetHeader("Content-Length", fmt.Sprintf("%d", size))
+		if req.Method == "HEAD" {
+			conn.WriteHeader(http.StatusOK)
+			return
+		}
+		sendBytes(conn, fileRef, fr, size)
+	case 1:
+		r := ranges[0]
+		fr.Seek(r.start, 0)
+		conn.SetHeader("Content-Type", contentType)
+		conn.SetHeader("Content-Range", r.contentRange(size))
+		conn.SetHeader("Content-Length", fmt.Sprintf("%d", r.length()))
+		conn.WriteHeader(http.StatusPartialContent)
+		sendBytes(conn, fileRef, fr, r.length())
+	default:
+		sendMultipartRanges(conn, fileRef, fr, size, ranges)
+	}
+}
+
+// contentDisposition returns a Content-Disposition header value
+// telling browsers to save a download as name.  Names that aren't
+// plain ASCII are also given in RFC 5987 form.
+func contentDisposition(name string) string {
+	ascii := true
+	quoted := make([]byte, 0, len(name))
+	encoded := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c < 0x20 || c >= 0x7f:
+			ascii = false
+			quoted = append(quoted, '_')
+		case c == '"' || c == '\\':
+			quoted = append(quoted, '\\', c)
+		default:
+			quoted = append(quoted, c)
+		}
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			strings.IndexRune("!#$&+-.^_`|~", int(c)) != -1 {
+			encoded = append(encoded, c)
+		} else {
+			encoded = append(encoded, []byte(fmt.Sprintf("%%%02X", c))...)
+		}
+	}
+	value := fmt.Sprintf("attachment; filename=\"%s\"", quoted)
+	if !ascii {
+		value += "; filename*=UTF-8''" + string(encoded)
+	}
+	return value
+}
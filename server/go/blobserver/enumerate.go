@@ -18,128 +18,110 @@ package main
 
 import (
 	"camli/blobref"
+	"camli/blobserver"
 	"fmt"
 	"http"
-	"os"
 	"log"
-	"sort"
+	"os"
 	"strconv"
-	"strings"
+	"time"
 )
 
 const maxEnumerate = 100000
 
-type blobInfo struct {
-	*blobref.BlobRef
-	*os.FileInfo
-	os.Error
-}
+// maxEnumerateWait is the longest, in seconds, that a client may ask
+// an enumerate request to wait for new blobs.
+const maxEnumerateWait = 30
 
-func readBlobs(ch chan *blobInfo, blobPrefix, diskRoot, after string, remain *uint) {
-	dirFullPath := *flagStorageRoot + "/" + diskRoot
-	dir, err := os.Open(dirFullPath, os.O_RDONLY, 0)
-	if err != nil {
-		log.Println("Error opening directory: ", err)
-		ch <- &blobInfo{Error: err}
-		return
-	}
-	defer dir.Close()
-	names, err := dir.Readdirnames(32768)
-	if err != nil {
-		log.Println("Error reading dirnames: ", err)
-		ch <- &blobInfo{Error: err}
-		return
-	}
-	sort.SortStrings(names)
-	for _, name := range names {
-		if *remain == 0 {
-			ch <- &blobInfo{Error: os.ENOSPC}
-			return
-		}
-
-		fullPath := dirFullPath + "/" + name
-		fi, err := os.Stat(fullPath)
-		if err != nil {
-			bi := &blobInfo{Error: err}
-			ch <- bi
-			return
-		}
-
-		if fi.IsDirectory() {
-			var newBlobPrefix string
-			if blobPrefix == "" {
-				newBlobPrefix = name + "-"
-			} else {
-				newBlobPrefix = blobPrefix + name
-			}
-			if len(after) > 0 {
-				compareLen := len(newBlobPrefix)
-				if len(after) < compareLen {
-					compareLen = len(after)
-				}
-				if newBlobPrefix[0:compareLen] < after[0:compareLen] {
-					continue
-				}
-			}
-			readBlobs(ch, newBlobPrefix, diskRoot+"/"+name, after, remain)
-			continue
-		}
-
-		if fi.IsRegular() && strings.HasSuffix(name, ".dat") {
-			blobName := name[0 : len(name)-4]
-			if blobName <= after {
-				continue
-			}
-			blobRef := blobref.Parse(blobName)
-			if blobRef != nil {
-				bi := &blobInfo{BlobRef: blobRef, FileInfo: fi}
-				ch <- bi
-				(*remain)--
-			}
-			continue
-		}
-	}
-
-	if diskRoot == "" {
-		ch <- nil
+func createEnumerateHandler(storage blobserver.BlobEnumerator) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleEnumerateBlobs(conn, req, storage)
 	}
 }
 
-func handleEnumerateBlobs(conn http.ResponseWriter, req *http.Request) {
+func handleEnumerateBlobs(conn http.ResponseWriter, req *http.Request, storage blobserver.BlobEnumerator) {
 	req.ParseForm()
-	ch := make(chan *blobInfo, 100)
-
 	limit, err := strconv.Atoui(req.FormValue("limit"))
-	if err != nil || limit > maxEnumerate {
+	if err != nil || limit == 0 || limit > maxEnumerate {
 		limit = maxEnumerate
 	}
+	waitSeconds, _ := strconv.Atoi(req.FormValue("maxwaitsec"))
+	if waitSeconds > maxEnumerateWait {
+		waitSeconds = maxEnumerateWait
+	}
+	if waitSeconds > 0 {
+		waitForBlobs(storage, req.FormValue("after"), waitSeconds)
+	}
 
 	conn.SetHeader("Content-Type", "text/javascript; charset=utf-8")
 	fmt.Fprintf(conn, "{\n  \"blobs\": [\n")
 
-	var after string
-	go readBlobs(ch, "", "", req.FormValue("after"), &limit)
-	needsComma := false
-	for bi := range ch {
-		if bi == nil {
-			after = ""
-			break
-		}
-		if bi.Error != nil {
+	// Ask for one more than the limit, so we know whether to
+	// tell the client to continue after the last one we send.
+	ch := make(chan *blobref.SizedBlobRef, 100)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- storage.EnumerateBlobs(ch, req.FormValue("after"), limit+1)
+	}()
+
+	var lastBlob string
+	more := false
+	n := uint(0)
+	for sb := range ch {
+		if n == limit {
+			// The extra one we asked for; there are more.
+			more = true
+			for _ = range ch {
+			}
 			break
 		}
-		blobName := bi.BlobRef.String()
-		if needsComma {
+		lastBlob = sb.BlobRef.String()
+		if n > 0 {
 			fmt.Fprintf(conn, ",\n")
 		}
 		fmt.Fprintf(conn, "    {\"blobRef\": \"%s\", \"size\": %d}",
-			blobName, bi.FileInfo.Size)
-		after = blobName
-		needsComma = true
+			lastBlob, sb.Size)
+		n++
+	}
+	if err := <-errch; err != nil {
+		log.Printf("Error enumerating blobs: %v", err)
 	}
 	fmt.Fprintf(conn, "\n  ]")
-	if after != "" {
-		fmt.Fprintf(conn, ",\n  \"after\": \"%s\"", after)
+	if more {
+		fmt.Fprintf(conn, ",\n  \"after\": \"%s\"", lastBlob)
 	}
 	fmt.Fprintf(conn, "\n}\n")
 }
+
+// waitForBlobs blocks until storage has a blob after after, or for at
+// most waitSeconds.
+func waitForBlobs(storage blobserver.BlobEnumerator, after string, waitSeconds int) {
+	// Listen before looking, so a blob arriving in between isn't
+	// missed.
+	hub := blobserver.GetHub(storage)
+	newBlob := make(chan *blobref.BlobRef, 1)
+	hub.RegisterListener(newBlob)
+	defer hub.UnregisterListener(newBlob)
+
+	deadline := time.Nanoseconds() + int64(waitSeconds)*1e9
+	for !haveBlobsAfter(storage, after) {
+		remain := deadline - time.Nanoseconds()
+		if remain <= 0 {
+			return
+		}
+		select {
+		case <-newBlob:
+		case <-time.After(remain):
+			return
+		}
+	}
+}
+
+func haveBlobsAfter(storage blobserver.BlobEnumerator, after string) bool {
+	ch := make(chan *blobref.SizedBlobRef, 1)
+	if err := storage.EnumerateBlobs(ch, after, 1); err != nil {
+		log.Printf("Error enumerating blobs: %v", err)
+	}
+	_, ok := <-ch
+	return ok
+}
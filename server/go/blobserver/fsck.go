@@ -0,0 +1,66 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"camli/blobserver/localdisk"
+	"fmt"
+	"json"
+	"os"
+)
+
+// runFsck checks the localdisk storage under -root and writes a JSON
+// report to stdout, exiting with status 1 if any blob was corrupt or
+// couldn't be checked.
+func runFsck() {
+	if *flagStorageConfig != "" || *flagStorageType != "localdisk" || *flagStorageRoot == ":memory:" {
+		fmt.Fprintf(os.Stderr, "-fsck only supports -storage=localdisk with a -root directory\n")
+		os.Exit(1)
+	}
+	quarantineDir := *flagQuarantine
+	if quarantineDir == "" {
+		quarantineDir = *flagStorageRoot + "-quarantine"
+	}
+	res, err := localdisk.Fsck(*flagStorageRoot, quarantineDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	corrupt := make([]string, len(res.Corrupt))
+	for i, blob := range res.Corrupt {
+		corrupt[i] = blob.String()
+	}
+	report := map[string]interface{}{
+		"checked":       res.Checked,
+		"ok":            res.Checked - len(res.Corrupt) - len(res.Errors),
+		"corrupt":       len(res.Corrupt),
+		"corruptBlobs":  corrupt,
+		"errors":        res.Errors,
+		"quarantineDir": quarantineDir,
+	}
+	bytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "JSON serialization error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(bytes)
+	os.Stdout.Write([]byte("\n"))
+	if len(res.Corrupt) > 0 || len(res.Errors) > 0 {
+		os.Exit(1)
+	}
+}
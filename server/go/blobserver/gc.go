@@ -0,0 +1,67 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"camli/blobserver/gc"
+	"fmt"
+	"json"
+	"os"
+)
+
+// runGC garbage collects storage and writes a JSON report to stdout.
+func runGC() {
+	collector := &gc.Collector{
+		Storage: storage,
+		Grace:   *flagGCGrace * 1e9,
+		DryRun:  *flagGCDryRun,
+	}
+	res, err := collector.Collect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Garbage collection failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	roots := make([]string, len(res.Roots))
+	for i, root := range res.Roots {
+		roots[i] = root.String()
+	}
+	garbage := make([]map[string]interface{}, len(res.Garbage))
+	garbageBytes := int64(0)
+	for i, sb := range res.Garbage {
+		garbage[i] = map[string]interface{}{
+			"blobRef": sb.BlobRef.String(),
+			"size":    sb.Size,
+		}
+		garbageBytes += sb.Size
+	}
+	report := map[string]interface{}{
+		"dryRun":       *flagGCDryRun,
+		"roots":        roots,
+		"reachable":    res.Reachable,
+		"young":        res.Young,
+		"garbage":      garbage,
+		"garbageBytes": garbageBytes,
+	}
+	bytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "JSON serialization error: %v\n", err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(bytes)
+	os.Stdout.Write([]byte("\n"))
+}
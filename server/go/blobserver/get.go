@@ -21,14 +21,15 @@ import (
 	"bytes"
 	"camli/auth"
 	"camli/blobref"
+	"camli/blobserver/share"
 	"camli/httputil"
 	"fmt"
 	"http"
 	"os"
 	"io"
-	"io/ioutil"
-	"json"
 	"log"
+	"rand"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -39,16 +40,32 @@ func createGetHandler(fetcher blobref.Fetcher) func(http.ResponseWriter, *http.R
 	}
 }
 
+var kGetPutPattern *regexp.Regexp = regexp.MustCompile(`^/camli/([a-z0-9]+)-([a-f0-9]+)$`)
+
+func BlobFromUrlPath(path string) *blobref.BlobRef {
+	return blobref.FromPattern(kGetPutPattern, path)
+}
+
 const fetchFailureDelayNs = 200e6 // 200 ms
-const maxJsonSize = 64 * 1024     // should be enough for everyone
+
+// shares decides which share chains grant access to blobs for
+// requests without the password.
+var shares *share.Authorizer
 
 func sendUnauthorized(conn http.ResponseWriter) {
 	conn.WriteHeader(http.StatusUnauthorized)
 	fmt.Fprintf(conn, "<h1>Unauthorized</h1>")
 }
 
+// sendForbidden refuses a request made through a genuine share that
+// no longer grants access.
+func sendForbidden(conn http.ResponseWriter, reason string) {
+	conn.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(conn, "<h1>%s</h1>", reason)
+}
+
 func handleGet(conn http.ResponseWriter, req *http.Request, fetcher blobref.Fetcher) {
-	isOwner := auth.IsAuthorized(req)
+	isOwner := auth.IsAuthorized(req, auth.ScopeRead)
 
 	blobRef := BlobFromUrlPath(req.URL.Path)
 	if blobRef == nil {
@@ -82,69 +99,21 @@ func handleGet(conn http.ResponseWriter, req *http.Request, fetcher blobref.Fetc
 			}
 		}
 
-		fetchChain := make([]*blobref.BlobRef, 0)
-		fetchChain = append(fetchChain, viaBlobs...)
-		fetchChain = append(fetchChain, blobRef)
-		for i, br := range fetchChain {
-			switch i {
-			case 0:
-				file, size, err := fetcher.Fetch(br)
-				if err != nil {
-					log.Printf("Fetch chain 0 of %s failed: %v", br.String(), err)
-					sendUnauthorized(conn)
-					return
-				}
-				defer file.Close()
-				if size > maxJsonSize {
-					log.Printf("Fetch chain 0 of %s too large", br.String())
-					sendUnauthorized(conn)
-					return
-				}
-				jd := json.NewDecoder(file)
-				m := make(map[string]interface{})
-				if err := jd.Decode(&m); err != nil {
-					log.Printf("Fetch chain 0 of %s wasn't JSON: %v", br.String(), err)
-					sendUnauthorized(conn)
-					return
-				}
-				if m["camliType"].(string) != "share" {
-					log.Printf("Fetch chain 0 of %s wasn't a share", br.String())
-					sendUnauthorized(conn)
-					return
-				}
-				if len(fetchChain) > 1 && fetchChain[1].String() != m["target"].(string) {
-					log.Printf("Fetch chain 0->1 (%s -> %q) unauthorized, expected hop to %q",
-						br.String(), fetchChain[1].String(), m["target"])
-					sendUnauthorized(conn)
-					return
-				}
-			case len(fetchChain) - 1:
-				// Last one is fine (as long as its path up to here has been proven, and it's
-				// not the first thing in the chain)
-				continue
-			default:
-				file, _, err := fetcher.Fetch(br)
-				if err != nil {
-					log.Printf("Fetch chain %d of %s failed: %v", i, br.String(), err)
-					sendUnauthorized(conn)
-					return
-				}
-				defer file.Close()
-				lr := io.LimitReader(file, maxJsonSize)
-				slurpBytes, err := ioutil.ReadAll(lr)
-				if err != nil {
-					log.Printf("Fetch chain %d of %s failed in slurp: %v", i, br.String(), err)
-					sendUnauthorized(conn)
-					return
-				}
-				saught := fetchChain[i+1].String()
-				if bytes.IndexAny(slurpBytes, saught) == -1 {
-					log.Printf("Fetch chain %d of %s failed; no reference to %s",
-						i, br.String(), saught)
-					sendUnauthorized(conn)
-					return
-				}
-			}
+		fetchChain := append(viaBlobs, blobRef)
+		switch err := shares.Authorize(fetchChain); err.(type) {
+		case nil:
+		case *share.ExpiredError:
+			log.Printf("Share chain to %s refused: %v", blobRef, err)
+			sendForbidden(conn, "Share expired")
+			return
+		case *share.RevokedError:
+			log.Printf("Share chain to %s refused: %v", blobRef, err)
+			sendForbidden(conn, "Share revoked")
+			return
+		default:
+			log.Printf("Share chain to %s refused: %v", blobRef, err)
+			sendUnauthorized(conn)
+			return
 		}
 		viaPathOkay = true
 	}
@@ -164,79 +133,138 @@ func handleGet(conn http.ResponseWriter, req *http.Request, fetcher blobref.Fetc
 
 	defer file.Close()
 
-	reqRange := getRequestedRange(req)
-	if reqRange.SkipBytes != 0 {
-		_, err = file.Seek(reqRange.SkipBytes, 0)
-		if err != nil {
+	// Blobs never change, so they can be cached for as long as
+	// clients like.
+	etag := fmt.Sprintf("%q", blobRef.String())
+	conn.SetHeader("ETag", etag)
+	conn.SetHeader("Cache-Control", fmt.Sprintf("private, max-age=%d", blobMaxAgeSeconds))
+	conn.SetHeader("Accept-Ranges", "bytes")
+	if etagMatches(req.Header["If-None-Match"], etag) {
+		conn.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if req.Method == "HEAD" {
+		conn.SetHeader("Content-Type", "application/octet-stream")
+		conn.SetHeader("Content-Length", fmt.Sprintf("%d", size))
+		conn.WriteHeader(http.StatusOK)
+		return
+	}
+
+	ranges, err := parseRange(req.Header["Range"], size)
+	if err != nil {
+		conn.SetHeader("Content-Range", fmt.Sprintf("bytes */%d", size))
+		conn.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	switch len(ranges) {
+	case 0:
+		sendWholeBlob(conn, blobRef, file, size)
+	case 1:
+		r := ranges[0]
+		if _, err := file.Seek(r.start, 0); err != nil {
 			httputil.ServerError(conn, err)
 			return
 		}
+		conn.SetHeader("Content-Type", "application/octet-stream")
+		conn.SetHeader("Content-Range", r.contentRange(size))
+		conn.SetHeader("Content-Length", fmt.Sprintf("%d", r.length()))
+		conn.WriteHeader(http.StatusPartialContent)
+		sendBytes(conn, blobRef, file, r.length())
+	default:
+		sendMultipartRanges(conn, blobRef, file, size, ranges)
 	}
+}
 
-	var input io.Reader = file
-	if reqRange.LimitBytes != -1 {
-		input = io.LimitReader(file, reqRange.LimitBytes)
-	}
+// blobMaxAgeSeconds is the Cache-Control max-age of blobs: a year.
+const blobMaxAgeSeconds = 365 * 24 * 60 * 60
 
-	remainBytes := size - reqRange.SkipBytes
-	if reqRange.LimitBytes != -1 &&
-		reqRange.LimitBytes < remainBytes {
-		remainBytes = reqRange.LimitBytes
+// etagMatches reports whether an If-None-Match header value lists
+// etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",", -1) {
+		tag = strings.TrimSpace(tag)
+		if tag == etag || tag == "*" {
+			return true
+		}
 	}
+	return false
+}
 
+func sendWholeBlob(conn http.ResponseWriter, blobRef *blobref.BlobRef, file io.Reader, size int64) {
 	// Assume this generic content type by default.  For better
 	// demos we'll try to sniff and guess the "right" MIME type in
 	// certain cases (no Range requests, etc) but this isn't part
 	// of the Camli spec at all.  We just do it to ease demos.
 	contentType := "application/octet-stream"
-	if reqRange.IsWholeFile() {
-		const peekSize = 1024
-		bufReader, _ := bufio.NewReaderSize(input, peekSize)
-		header, _ := bufReader.Peek(peekSize)
-		if len(header) >= 8 {
-			switch {
-			case isValidUtf8(string(header)):
-				contentType = "text/plain; charset=utf-8"
-			case bytes.HasPrefix(header, []byte{0xff, 0xd8, 0xff, 0xe2}):
-				contentType = "image/jpeg"
-			case bytes.HasPrefix(header, []byte{0x89, 0x50, 0x4e, 0x47, 0xd, 0xa, 0x1a, 0xa}):
-				contentType = "image/png"
-			}
+	const peekSize = 1024
+	bufReader, _ := bufio.NewReaderSize(file, peekSize)
+	header, _ := bufReader.Peek(peekSize)
+	if len(header) >= 8 {
+		switch {
+		case isValidUtf8(string(header)):
+			contentType = "text/plain; charset=utf-8"
+		case bytes.HasPrefix(header, []byte{0xff, 0xd8, 0xff, 0xe2}):
+			contentType = "image/jpeg"
+		case bytes.HasPrefix(header, []byte{0x89, 0x50, 0x4e, 0x47, 0xd, 0xa, 0x1a, 0xa}):
+			contentType = "image/png"
 		}
-		input = bufReader
 	}
 
 	conn.SetHeader("Content-Type", contentType)
-	if !reqRange.IsWholeFile() {
-		conn.SetHeader("Content-Range",
-			fmt.Sprintf("bytes %d-%d/%d", reqRange.SkipBytes,
-				reqRange.SkipBytes+remainBytes,
-				size))
-		conn.WriteHeader(http.StatusPartialContent)
+	conn.SetHeader("Content-Length", fmt.Sprintf("%d", size))
+	sendBytes(conn, blobRef, bufReader, size)
+}
+
+// sendMultipartRanges sends several ranges of a blob as a
+// multipart/byteranges response.
+func sendMultipartRanges(conn http.ResponseWriter, blobRef *blobref.BlobRef, file io.ReadSeeker, size int64, ranges []byteRange) {
+	boundary := fmt.Sprintf("%016x%016x", rand.Int63(), rand.Int63())
+	conn.SetHeader("Content-Type", "multipart/byteranges; boundary="+boundary)
+	conn.WriteHeader(http.StatusPartialContent)
+	for _, r := range ranges {
+		fmt.Fprintf(conn, "--%s\r\nContent-Type: application/octet-stream\r\nContent-Range: %s\r\n\r\n",
+			boundary, r.contentRange(size))
+		if _, err := file.Seek(r.start, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "Error seeking in file: %v, err=%v\n", blobRef, err)
+			killConnection(conn)
+			return
+		}
+		if !sendBytes(conn, blobRef, file, r.length()) {
+			return
+		}
+		fmt.Fprintf(conn, "\r\n")
 	}
-	bytesCopied, err := io.Copy(conn, input)
+	fmt.Fprintf(conn, "--%s--\r\n", boundary)
+}
+
+// sendBytes copies n bytes of a blob from r to conn, reporting
+// whether it succeeded.
+func sendBytes(conn http.ResponseWriter, blobRef *blobref.BlobRef, r io.Reader, n int64) bool {
+	bytesCopied, err := io.Copy(conn, io.LimitReader(r, n))
 
 	// If there's an error at this point, it's too late to tell the client,
 	// as they've already been receiving bytes.  But they should be smart enough
 	// to verify the digest doesn't match.  But we close the (chunked) response anyway,
 	// to further signal errors.
-	killConnection := func() {
-		closer, _, err := conn.Hijack()
-		if err != nil {
-			closer.Close()
-		}
-	}
-
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error sending file: %v, err=%v\n", blobRef, err)
-		killConnection()
-		return
+		killConnection(conn)
+		return false
 	}
-	if bytesCopied != remainBytes {
+	if bytesCopied != n {
 		fmt.Fprintf(os.Stderr, "Error sending file: %v, copied=%d, not %d\n", blobRef,
-			bytesCopied, remainBytes)
-		killConnection()
-		return
+			bytesCopied, n)
+		killConnection(conn)
+		return false
+	}
+	return true
+}
+
+func killConnection(conn http.ResponseWriter) {
+	closer, _, err := conn.Hijack()
+	if err == nil {
+		closer.Close()
 	}
 }
 
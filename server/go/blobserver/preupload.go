@@ -18,14 +18,21 @@ package main
 
 import (
 	"camli/blobref"
+	"camli/blobserver"
 	"camli/httputil"
-	"container/vector"
 	"fmt"
 	"http"
+	"log"
 	"os"
 )
 
-func handlePreUpload(conn http.ResponseWriter, req *http.Request) {
+func createPreUploadHandler(storage blobserver.BlobStatter) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handlePreUpload(conn, req, storage)
+	}
+}
+
+func handlePreUpload(conn http.ResponseWriter, req *http.Request, storage blobserver.BlobStatter) {
 	if !(req.Method == "POST" && req.URL.Path == "/camli/preupload") {
 		httputil.BadRequestError(conn, "Inconfigured handler.")
 		return
@@ -37,53 +44,91 @@ func handlePreUpload(conn http.ResponseWriter, req *http.Request) {
 		httputil.BadRequestError(conn, "No camliversion")
 		return
 	}
-	n := 0
-	haveVector := new(vector.Vector)
 
-	haveChan := make(chan *map[string]interface{})
-	for {
-		key := fmt.Sprintf("blob%v", n+1)
+	blobs, err := blobsFromForm(req, 0)
+	if err != nil {
+		httputil.BadRequestError(conn, err.String())
+		return
+	}
+
+	haveChan := make(chan *blobref.SizedBlobRef)
+	errChan := make(chan os.Error, 1)
+	go func() {
+		errChan <- storage.Stat(haveChan, blobs)
+		close(haveChan)
+	}()
+
+	alreadyHave := make([]map[string]interface{}, 0)
+	have := make(map[string]bool)
+	for sb := range haveChan {
+		info := make(map[string]interface{})
+		info["blobRef"] = sb.BlobRef.String()
+		info["size"] = sb.Size
+		alreadyHave = append(alreadyHave, info)
+		have[sb.BlobRef.String()] = true
+	}
+	if err := <-errChan; err != nil {
+		log.Printf("Stat error in preupload: %v", err)
+		httputil.ServerError(conn, err)
+		return
+	}
+
+	ret := commonUploadResponse(req)
+	ret["alreadyHave"] = alreadyHave
+	if ps, ok := storage.(blobserver.PartialUploadStorage); ok {
+		havePartially := make([]map[string]interface{}, 0)
+		for _, blob := range blobs {
+			if have[blob.String()] {
+				continue
+			}
+			partials, err := ps.PartialUploads(blob)
+			if err != nil {
+				log.Printf("Error finding partial uploads of %s: %v", blob, err)
+				continue
+			}
+			for _, p := range partials {
+				havePartially = append(havePartially, map[string]interface{}{
+					"blobRef":     p.BlobRef.String(),
+					"size":        p.Size,
+					"partBlobRef": p.PartBlobRef.String(),
+					"resumeKey":   p.ResumeKey(),
+				})
+			}
+		}
+		if len(havePartially) > 0 {
+			ret["alreadyHavePartially"] = havePartially
+		}
+	}
+	if len(alreadyHave) < len(blobs) && quota.remaining() <= 0 {
+		quotaExceededResponse(conn, ret)
+		return
+	}
+	httputil.ReturnJson(conn, ret)
+}
+
+// blobsFromForm returns the blobrefs in the blob1, blob2, ...
+// form values of a parsed request, as used by preupload, stat and
+// remove.  If max is positive, it stops with an error as soon as
+// there are more than max of them.
+func blobsFromForm(req *http.Request, max int) ([]*blobref.BlobRef, os.Error) {
+	blobs := make([]*blobref.BlobRef, 0)
+	for n := 1; ; n++ {
+		key := fmt.Sprintf("blob%v", n)
 		value := req.FormValue(key)
 		if value == "" {
 			break
 		}
+		if max > 0 && n > max {
+			return nil, os.NewError(fmt.Sprintf("Too many blobs; at most %d per request", max))
+		}
 		ref := blobref.Parse(value)
 		if ref == nil {
-			httputil.BadRequestError(conn, "Bogus blobref for key "+key)
-			return
+			return nil, os.NewError("Bogus blobref for key " + key)
 		}
 		if !ref.IsSupported() {
-			httputil.BadRequestError(conn, "Unsupported or bogus blobref "+key)
+			return nil, os.NewError("Unsupported or bogus blobref " + key)
 		}
-		n++
-
-		// Parallel stat all the files...
-		go func() {
-			fi, err := os.Stat(BlobFileName(ref))
-			if err == nil && fi.IsRegular() {
-				info := make(map[string]interface{})
-				info["blobRef"] = ref.String()
-				info["size"] = fi.Size
-				haveChan <- &info
-			} else {
-				haveChan <- nil
-			}
-		}()
+		blobs = append(blobs, ref)
 	}
-
-	if n > 0 {
-		for have := range haveChan {
-			if have != nil {
-				haveVector.Push(have)
-			}
-			n--
-			if n == 0 {
-				break
-			}
-		}
-	}
-
-	ret := commonUploadResponse(req)
-	ret["alreadyHave"] = haveVector.Copy()
-	httputil.ReturnJson(conn, ret)
+	return blobs, nil
 }
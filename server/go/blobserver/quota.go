@@ -0,0 +1,140 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/httputil"
+	"fmt"
+	"http"
+	"io"
+	"os"
+	"sync"
+)
+
+// quotaTracker keeps a running total of the bytes in storage, so new
+// blobs can be refused once -quota is reached.  Concurrent uploads may
+// overshoot the quota slightly.
+type quotaTracker struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// quota is nil if there's no quota.
+var quota *quotaTracker
+
+func newQuotaTracker(storage blobserver.BlobEnumerator, limit int64) (*quotaTracker, os.Error) {
+	q := &quotaTracker{limit: limit}
+	err := blobserver.EnumerateAll(storage, func(sb *blobref.SizedBlobRef) {
+		q.used += sb.Size
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// remaining returns how many more bytes may be stored.
+func (q *quotaTracker) remaining() int64 {
+	if q == nil {
+		return 1<<63 - 1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit - q.used
+}
+
+func (q *quotaTracker) add(n int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used += n
+}
+
+func (q *quotaTracker) errorText() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return fmt.Sprintf("Storage quota of %d bytes reached (%d bytes used); not accepting new blobs",
+		q.limit, q.used)
+}
+
+var (
+	blobTooLargeError  = os.NewError("blob exceeds maxUploadSize")
+	quotaExceededError = os.NewError("storage quota exceeded")
+)
+
+// limitedBlobReader reads an uploaded blob, failing once it's read
+// more than -maxuploadsize bytes or the remaining quota.
+type limitedBlobReader struct {
+	r         io.Reader
+	quotaLeft int64
+	n         int64
+	err       os.Error // the limit hit, if any
+}
+
+func newLimitedBlobReader(r io.Reader) *limitedBlobReader {
+	return &limitedBlobReader{r: r, quotaLeft: quota.remaining()}
+}
+
+func (lr *limitedBlobReader) Read(p []byte) (n int, err os.Error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	n, err = lr.r.Read(p)
+	lr.n += int64(n)
+	switch {
+	case lr.n > *flagMaxUploadSize:
+		lr.err = blobTooLargeError
+	case lr.n > lr.quotaLeft:
+		lr.err = quotaExceededError
+	}
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	return
+}
+
+// haveBlob reports whether storage already has blob, so it doesn't
+// count against the quota again.
+func haveBlob(storage blobserver.BlobStatter, blob *blobref.BlobRef) bool {
+	ch := make(chan *blobref.SizedBlobRef)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- storage.Stat(ch, []*blobref.BlobRef{blob})
+		close(ch)
+	}()
+	have := false
+	for _ = range ch {
+		have = true
+	}
+	return <-errch == nil && have
+}
+
+// quotaExceededResponse refuses a request because the quota has been
+// reached, adding an explanation to ret.
+func quotaExceededResponse(conn http.ResponseWriter, ret map[string]interface{}) {
+	ret["errorText"] = quota.errorText()
+	ret["quotaExceeded"] = true
+	conn.SetHeader("Content-Type", "text/javascript")
+	conn.WriteHeader(507) // Insufficient Storage
+	httputil.ReturnJson(conn, ret)
+}
@@ -17,49 +17,106 @@ limitations under the License.
 package main
 
 import (
-	"http"
-	"regexp"
+	"fmt"
+	"os"
 	"strconv"
+	"strings"
 )
 
-// Default is {0, -1} to read all of a file.
-type requestedRange struct {
-	SkipBytes  int64
-	LimitBytes int64 // or -1 to read all
+// byteRange is a range of bytes in a blob, from start to end
+// inclusive, as in an HTTP Range header.
+type byteRange struct {
+	start, end int64
 }
 
-func (rr *requestedRange) IsWholeFile() bool {
-	return rr.SkipBytes == 0 && rr.LimitBytes == -1
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
 }
 
-var wholeRange = &requestedRange{0, -1}
+// contentRange returns the value of the Content-Range header for r,
+// in a blob of size bytes.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
 
-var rangePattern = regexp.MustCompile(`bytes=([0-9]+)-([0-9]*)`)
+var errUnsatisfiableRange = os.NewError("requested range not satisfiable")
 
-func getRequestedRange(req *http.Request) *requestedRange {
-	rrange, ok := req.Header["Range"]
-	if !ok {
-		return wholeRange
-	}
-	return getRequestedRangeFromString(rrange)
-}
+// maxRanges is the most ranges honored in one Range header; a request
+// for more gets the whole blob.
+const maxRanges = 16
 
-func getRequestedRangeFromString(rrange string) *requestedRange {
-	matches := rangePattern.FindStringSubmatch(rrange)
-	if len(matches) == 0 {
-		return wholeRange
+// parseRange parses the value of a Range header for a blob of size
+// bytes.  It returns no ranges if the whole blob should be sent,
+// either because there was no header or because the header was
+// malformed, which RFC 2616 says to ignore.  The whole blob is also
+// sent for more than maxRanges ranges, or ranges that overlap or add
+// up to more than the blob, rather than amplifying the response.  If
+// no range overlaps the blob, it returns errUnsatisfiableRange.
+func parseRange(s string, size int64) ([]byteRange, os.Error) {
+	if s == "" {
+		return nil, nil
+	}
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) {
+		return nil, nil
+	}
+	specs := strings.Split(s[len(prefix):], ",", -1)
+	if len(specs) > maxRanges {
+		return nil, nil
+	}
+	var ranges []byteRange
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		dash := strings.Index(spec, "-")
+		if dash == -1 {
+			return nil, nil
+		}
+		startStr, endStr := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+		var r byteRange
+		if startStr == "" {
+			// A suffix range: the last n bytes.
+			n, err := strconv.Atoi64(endStr)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{size - n, size - 1}
+		} else {
+			start, err := strconv.Atoi64(startStr)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if endStr != "" {
+				if end, err = strconv.Atoi64(endStr); err != nil || end < start {
+					return nil, nil
+				}
+			}
+			if start >= size {
+				continue
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r = byteRange{start, end}
+		}
+		ranges = append(ranges, r)
 	}
-	skipBytes, _ := strconv.Atoi64(matches[1])
-	lastByteInclusive := int64(-1)
-	if len(matches[2]) > 0 {
-		lastByteInclusive, _ = strconv.Atoi64(matches[2])
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
 	}
-	limitBytes := int64(-1)
-	if lastByteInclusive != -1 {
-		limitBytes = lastByteInclusive - skipBytes + 1
-		if limitBytes < 0 {
-			limitBytes = 0
+	// Ranges that don't overlap can't add up to more than the blob.
+	for i, r := range ranges {
+		for _, o := range ranges[:i] {
+			if r.start <= o.end && o.start <= r.end {
+				return nil, nil
+			}
 		}
 	}
-	return &requestedRange{skipBytes, limitBytes}
+	return ranges, nil
 }
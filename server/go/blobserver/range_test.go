@@ -16,8 +16,63 @@ limitations under the License.
 
 package main
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
-func testRange(t *t.Testing) {
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   string // fmt of the ranges, or "unsatisfiable"
+	}{
+		{"", 100, "[]"},
+		{"bytes=0-", 100, "[{0 99}]"},
+		{"bytes=0-0", 100, "[{0 0}]"},
+		{"bytes=10-19", 100, "[{10 19}]"},
+		{"bytes=90-200", 100, "[{90 99}]"},
+		{"bytes=-10", 100, "[{90 99}]"},
+		{"bytes=-200", 100, "[{0 99}]"},
+		{"bytes=0-9, 20-29,-5", 100, "[{0 9} {20 29} {95 99}]"},
+		{"bytes=100-", 100, "unsatisfiable"},
+		{"bytes=100-200", 100, "unsatisfiable"},
+		{"bytes=-0", 100, "unsatisfiable"},
+		{"bytes=0-", 0, "unsatisfiable"},
+		{"bytes=100-200,0-9", 100, "[{0 9}]"},
 
+		// Overlapping ranges, or too many; the whole blob.
+		{"bytes=0-9,5-14", 100, "[]"},
+		{"bytes=0-,-1", 100, "[]"},
+		{"bytes=10-19,0-10", 100, "[]"},
+		{"bytes=0-0,1-1,2-2,3-3,4-4,5-5,6-6,7-7,8-8,9-9,10-10,11-11,12-12,13-13,14-14,15-15", 100,
+			"[{0 0} {1 1} {2 2} {3 3} {4 4} {5 5} {6 6} {7 7} {8 8} {9 9} {10 10} {11 11} {12 12} {13 13} {14 14} {15 15}]"},
+		{"bytes=0-0,1-1,2-2,3-3,4-4,5-5,6-6,7-7,8-8,9-9,10-10,11-11,12-12,13-13,14-14,15-15,16-16", 100, "[]"},
+
+		// Malformed; ignored.
+		{"bytes=19-10", 100, "[]"},
+		{"bytes=x-10", 100, "[]"},
+		{"bytes=10", 100, "[]"},
+		{"pages=1-2", 100, "[]"},
+	}
+	for _, tt := range tests {
+		ranges, err := parseRange(tt.header, tt.size)
+		got := fmt.Sprint(ranges)
+		if err == errUnsatisfiableRange {
+			got = "unsatisfiable"
+		} else if err != nil {
+			got = err.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseRange(%q, %d) = %s; want %s", tt.header, tt.size, got, tt.want)
+		}
+	}
+
+	r := byteRange{10, 19}
+	if r.length() != 10 {
+		t.Errorf("length of %v = %d; want 10", r, r.length())
+	}
+	if cr := r.contentRange(100); cr != "bytes 10-19/100" {
+		t.Errorf("contentRange = %q; want \"bytes 10-19/100\"", cr)
+	}
 }
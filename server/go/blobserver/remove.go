@@ -0,0 +1,98 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/httputil"
+	"fmt"
+	"http"
+	"log"
+	"os"
+)
+
+type removeStorage interface {
+	blobserver.BlobStatter
+	blobserver.BlobRemover
+}
+
+func createRemoveHandler(storage removeStorage) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleRemove(conn, req, storage)
+	}
+}
+
+func handleRemove(conn http.ResponseWriter, req *http.Request, storage removeStorage) {
+	if !(req.Method == "POST" && req.URL.Path == "/camli/remove") {
+		httputil.BadRequestError(conn, "Inconfigured handler.")
+		return
+	}
+	if !*flagAllowRemove {
+		conn.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(conn, "Blob removal is disabled on this server.\n")
+		return
+	}
+
+	req.ParseForm()
+	if req.FormValue("camliversion") == "" {
+		httputil.BadRequestError(conn, "No camliversion")
+		return
+	}
+	blobs, err := blobsFromForm(req, 0)
+	if err != nil {
+		httputil.BadRequestError(conn, err.String())
+		return
+	}
+
+	// Only report the blobs we actually had as removed.
+	haveChan := make(chan *blobref.SizedBlobRef)
+	errChan := make(chan os.Error, 1)
+	go func() {
+		errChan <- storage.Stat(haveChan, blobs)
+		close(haveChan)
+	}()
+	toRemove := make([]*blobref.BlobRef, 0, len(blobs))
+	removedBytes := int64(0)
+	for sb := range haveChan {
+		toRemove = append(toRemove, sb.BlobRef)
+		removedBytes += sb.Size
+	}
+	if err := <-errChan; err != nil {
+		log.Printf("Stat error in remove: %v", err)
+		httputil.ServerError(conn, err)
+		return
+	}
+
+	if len(toRemove) > 0 {
+		if err := storage.RemoveBlobs(toRemove); err != nil {
+			log.Printf("Error removing blobs %v: %v", toRemove, err)
+			httputil.ServerError(conn, err)
+			return
+		}
+		quota.add(-removedBytes)
+	}
+
+	removed := make([]string, len(toRemove))
+	for i, blob := range toRemove {
+		log.Printf("Removed blob %v", blob)
+		removed[i] = blob.String()
+	}
+	ret := make(map[string]interface{})
+	ret["removed"] = removed
+	httputil.ReturnJson(conn, ret)
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/httputil"
+	"http"
+	"log"
+	"os"
+)
+
+// maxStatBlobs is the most blobs one stat request may name.
+const maxStatBlobs = 1000
+
+func createStatHandler(storage blobserver.BlobStatter) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleStat(conn, req, storage)
+	}
+}
+
+func handleStat(conn http.ResponseWriter, req *http.Request, storage blobserver.BlobStatter) {
+	req.ParseForm()
+	if req.FormValue("camliversion") == "" {
+		httputil.BadRequestError(conn, "No camliversion")
+		return
+	}
+
+	blobs, err := blobsFromForm(req, maxStatBlobs)
+	if err != nil {
+		httputil.BadRequestError(conn, err.String())
+		return
+	}
+
+	statChan := make(chan *blobref.SizedBlobRef)
+	errChan := make(chan os.Error, 1)
+	go func() {
+		errChan <- storage.Stat(statChan, blobs)
+		close(statChan)
+	}()
+
+	stat := make([]map[string]interface{}, 0)
+	for sb := range statChan {
+		stat = append(stat, map[string]interface{}{
+			"blobRef": sb.BlobRef.String(),
+			"size":    sb.Size,
+		})
+	}
+	if err := <-errChan; err != nil {
+		log.Printf("Stat error: %v", err)
+		httputil.ServerError(conn, err)
+		return
+	}
+
+	httputil.ReturnJson(conn, map[string]interface{}{"stat": stat})
+}
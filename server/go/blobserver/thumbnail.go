@@ -0,0 +1,287 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/httputil"
+	"camli/schema"
+	"fmt"
+	"http"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const thumbnailPrefix = "/camli/thumbnail/"
+
+const (
+	// defaultThumbnailSize is the maximum width and height of a
+	// thumbnail when the request doesn't give one.
+	defaultThumbnailSize = 200
+
+	// maxThumbnailSize bounds the mw and mh parameters.
+	maxThumbnailSize = 2000
+
+	// maxThumbnailSourceSize is the largest image, in bytes, that
+	// will be decoded for a thumbnail.
+	maxThumbnailSourceSize = 32 << 20
+
+	// maxThumbnailPixels bounds the width times height of an image
+	// that will be decoded, since a small compressed image can
+	// decode to a huge one.
+	maxThumbnailPixels = 25 * 1000 * 1000
+
+	// maxCachedThumbnailBytes bounds the total size of the
+	// thumbnails remembered by thumbnails.
+	maxCachedThumbnailBytes = 32 << 20
+
+	thumbnailQuality = 85
+)
+
+// thumbnailCache keeps recently made thumbnails in memory.  They
+// aren't stored as blobs: thumbnail requests only need read access,
+// and nothing would refer to the blobs, so they'd just be garbage.
+type thumbnailCache struct {
+	lk    sync.Mutex
+	m     map[string][]byte
+	bytes int64
+}
+
+var thumbnails = &thumbnailCache{m: make(map[string][]byte)}
+
+func thumbnailKey(blob *blobref.BlobRef, maxWidth, maxHeight int) string {
+	return fmt.Sprintf("%s-%dx%d", blob, maxWidth, maxHeight)
+}
+
+func (c *thumbnailCache) get(key string) []byte {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.m[key]
+}
+
+func (c *thumbnailCache) put(key string, thumb []byte) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if _, ok := c.m[key]; ok {
+		return
+	}
+	if c.bytes+int64(len(thumb)) > maxCachedThumbnailBytes {
+		c.m = make(map[string][]byte)
+		c.bytes = 0
+	}
+	c.m[key] = thumb
+	c.bytes += int64(len(thumb))
+}
+
+func createThumbnailHandler(storage blobserver.Storage) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleThumbnail(conn, req, storage)
+	}
+}
+
+// handleThumbnail serves a JPEG thumbnail of an image blob, or of the
+// image reassembled from a "file" schema blob, for requests of the
+// form /camli/thumbnail/<blobref>?mw=<max width>&mh=<max height>.
+func handleThumbnail(conn http.ResponseWriter, req *http.Request, storage blobserver.Storage) {
+	blob := blobref.Parse(req.URL.Path[len(thumbnailPrefix):])
+	if blob == nil {
+		httputil.BadRequestError(conn, "Malformed thumbnail URL.")
+		return
+	}
+	req.ParseForm()
+	maxWidth, err := thumbnailDimension(req.FormValue("mw"))
+	if err != nil {
+		httputil.BadRequestError(conn, "Bad mw parameter.")
+		return
+	}
+	maxHeight, err := thumbnailDimension(req.FormValue("mh"))
+	if err != nil {
+		httputil.BadRequestError(conn, "Bad mh parameter.")
+		return
+	}
+
+	// A thumbnail, like the blob it's made from, never changes.
+	key := thumbnailKey(blob, maxWidth, maxHeight)
+	etag := fmt.Sprintf("%q", key)
+	conn.SetHeader("ETag", etag)
+	conn.SetHeader("Cache-Control", fmt.Sprintf("private, max-age=%d", blobMaxAgeSeconds))
+	if etagMatches(req.Header["If-None-Match"], etag) {
+		conn.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if thumb := thumbnails.get(key); thumb != nil {
+		sendThumbnail(conn, req, blob, thumb)
+		return
+	}
+
+	src, err := openImage(storage, blob)
+	if err == os.ENOENT {
+		conn.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(conn, "Object not found.")
+		return
+	}
+	if err != nil {
+		httputil.BadRequestError(conn, err.String())
+		return
+	}
+	config, _, err := image.DecodeConfig(src)
+	src.Close()
+	if err != nil {
+		httputil.BadRequestError(conn, fmt.Sprintf("Blob is not a supported image: %v", err))
+		return
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		httputil.BadRequestError(conn, fmt.Sprintf("Image is %dx%d; too large to thumbnail.", config.Width, config.Height))
+		return
+	}
+	if src, err = openImage(storage, blob); err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	img, _, err := image.Decode(src)
+	src.Close()
+	if err != nil {
+		httputil.BadRequestError(conn, fmt.Sprintf("Blob is not a supported image: %v", err))
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleImage(img, maxWidth, maxHeight), &jpeg.Options{thumbnailQuality}); err != nil {
+		httputil.ServerError(conn, err)
+		return
+	}
+	thumbnails.put(key, buf.Bytes())
+	sendThumbnail(conn, req, blob, buf.Bytes())
+}
+
+// thumbnailDimension parses an mw or mh parameter.
+func thumbnailDimension(s string) (int, os.Error) {
+	if s == "" {
+		return defaultThumbnailSize, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > maxThumbnailSize {
+		return 0, os.EINVAL
+	}
+	return n, nil
+}
+
+// openImage returns the contents of blob, or of the file it describes
+// if it's a "file" schema blob.
+func openImage(fetcher blobref.Fetcher, blob *blobref.BlobRef) (io.ReadCloser, os.Error) {
+	m, err := schema.FetchMap(fetcher, blob)
+	if err == os.ENOENT {
+		return nil, err
+	}
+	if err == nil && m["camliType"] == "file" {
+		fr, err := schema.NewFileReader(fetcher, m)
+		if err != nil {
+			return nil, err
+		}
+		if fr.Size() > maxThumbnailSourceSize {
+			fr.Close()
+			return nil, os.NewError(fmt.Sprintf("File %s is too large to thumbnail.", blob))
+		}
+		return fr, nil
+	}
+	file, size, err := fetcher.Fetch(blob)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxThumbnailSourceSize {
+		file.Close()
+		return nil, os.NewError(fmt.Sprintf("Blob %s is too large to thumbnail.", blob))
+	}
+	return file, nil
+}
+
+// sendThumbnail sends thumb, the thumbnail of blob.
+func sendThumbnail(conn http.ResponseWriter, req *http.Request, blob *blobref.BlobRef, thumb []byte) {
+	conn.SetHeader("Content-Type", "image/jpeg")
+	conn.SetHeader("Content-Length", fmt.Sprintf("%d", len(thumb)))
+	if req.Method == "HEAD" {
+		conn.WriteHeader(http.StatusOK)
+		return
+	}
+	sendBytes(conn, blob, bytes.NewBuffer(thumb), int64(len(thumb)))
+}
+
+// scaleImage shrinks src to fit within maxWidth by maxHeight, keeping
+// its aspect ratio, by averaging the source pixels under each
+// destination pixel.  Images that already fit are only copied.
+// Transparent areas are drawn over white, since JPEG has no alpha.
+func scaleImage(src image.Image, maxWidth, maxHeight int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if dw > maxWidth {
+		dw, dh = maxWidth, dh*maxWidth/dw
+	}
+	if dh > maxHeight {
+		dw, dh = dw*maxHeight/dh, maxHeight
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(dw, dh)
+	for dy := 0; dy < dh; dy++ {
+		sy0, sy1 := dy*sh/dh, (dy+1)*sh/dh
+		if sy1 == sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < dw; dx++ {
+			sx0, sx1 := dx*sw/dw, (dx+1)*sw/dw
+			if sx1 == sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			// The colors are alpha-premultiplied, so adding
+			// the missing alpha composites them over white.
+			white := n*0xffff - a
+			dst.Set(dx, dy, image.RGBAColor{
+				uint8((r + white) / n >> 8),
+				uint8((g + white) / n >> 8),
+				uint8((bl + white) / n >> 8),
+				0xff,
+			})
+		}
+	}
+	return dst
+}
@@ -18,34 +18,34 @@ package main
 
 import (
 	"camli/blobref"
+	"camli/blobserver"
 	"camli/httputil"
-	"exec"
-	"flag"
 	"fmt"
 	"http"
-	"io"
-	"io/ioutil"
 	"log"
 	"mime"
-	"os"
 )
 
-type receivedBlob struct {
-	blobRef *blobref.BlobRef
-	size    int64
+// uploadStorage is what the upload handlers need: they check for
+// existing blobs to keep the quota accurate.
+type uploadStorage interface {
+	blobserver.BlobReceiver
+	blobserver.BlobStatter
 }
 
-var flagOpenImages *bool = flag.Bool("showimages", false, "Show images on receiving them with eog.")
-
-var CorruptBlobError = os.NewError("corrupt blob; digest doesn't match")
+func createUploadHandler(storage uploadStorage) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handleMultiPartUpload(conn, req, storage)
+	}
+}
 
-func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request) {
+func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request, storage uploadStorage) {
 	if !(req.Method == "POST" && req.URL.Path == "/camli/upload") {
 		httputil.BadRequestError(conn, "Inconfigured handler.")
 		return
 	}
 
-	receivedBlobs := make([]*receivedBlob, 0, 10)
+	receivedBlobs := make([]*blobref.SizedBlobRef, 0, 10)
 
 	multipart, err := req.MultipartReader()
 	if multipart == nil {
@@ -55,6 +55,8 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request) {
 	}
 
 	var errText string
+	quotaExceeded := false
+	partialFailures := make([]map[string]interface{}, 0)
 	addError := func(s string) {
 		log.Printf("Client error: %s", s)
 		if errText == "" {
@@ -82,10 +84,20 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request) {
 
 		formName := params["name"]
 		ref := blobref.Parse(formName)
+		// A resumed upload is named by the resume key from
+		// preupload; see doc/protocol/blob-upload-resume.txt.
+		partial := blobserver.ParseResumeKey(formName)
+		if partial != nil {
+			ref = partial.BlobRef
+		}
 		if ref == nil {
 			addError(fmt.Sprintf("Ignoring form key %q", formName))
 			continue
 		}
+		if !ref.IsSupported() {
+			addError(fmt.Sprintf("Unsupported hash function for blobref %s", ref))
+			continue
+		}
 
 		_, hasContentType := part.Header["Content-Type"]
 		if !hasContentType {
@@ -99,12 +111,60 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request) {
 			continue
 		}
 
-		blobGot, err := receiveBlob(ref, part)
+		if quota.remaining() <= 0 {
+			addError(fmt.Sprintf("Not storing blob %v: %s", ref, quota.errorText()))
+			quotaExceeded = true
+			continue
+		}
+		isNew := quota != nil && !haveBlob(storage, ref)
+
+		limitedPart := newLimitedBlobReader(part)
+		var blobGot *blobref.SizedBlobRef
+		if partial != nil {
+			ps, ok := storage.(blobserver.PartialUploadStorage)
+			if !ok {
+				addError(fmt.Sprintf("Can't resume upload of blob %v; storage doesn't keep partial uploads", ref))
+				continue
+			}
+			// The limits apply to the whole blob.
+			limitedPart.n = partial.Size
+			blobGot, err = ps.ResumeBlob(partial, limitedPart)
+		} else {
+			blobGot, err = storage.ReceiveBlob(ref, limitedPart)
+		}
+		switch limitedPart.err {
+		case blobTooLargeError:
+			// The rest of the part is skipped by NextPart.
+			discardPartialUploads(storage, ref)
+			addError(fmt.Sprintf("Blob %v exceeds maxUploadSize of %d bytes; not stored", ref, *flagMaxUploadSize))
+			continue
+		case quotaExceededError:
+			discardPartialUploads(storage, ref)
+			addError(fmt.Sprintf("Not storing blob %v: %s", ref, quota.errorText()))
+			quotaExceeded = true
+			continue
+		}
+		if pwe, ok := err.(*blobserver.PartialWriteError); ok {
+			// The part was fully read, so carry on with the
+			// rest of the upload.  The blob isn't listed in
+			// "received"; the client should retry it.
+			addError(fmt.Sprintf("Partial failure receiving blob %v: %v", ref, pwe))
+			partialFailures = append(partialFailures, map[string]interface{}{
+				"blobRef":   ref.String(),
+				"succeeded": pwe.Succeeded,
+				"required":  pwe.Required,
+			})
+			continue
+		}
 		if err != nil {
 			addError(fmt.Sprintf("Error receiving blob %v: %v\n", ref, err))
 			break
 		}
 		log.Printf("Received blob %v\n", blobGot)
+		blobserver.GetHub(storage).NotifyBlobReceived(blobGot.BlobRef)
+		if isNew {
+			quota.add(blobGot.Size)
+		}
 		receivedBlobs = append(receivedBlobs, blobGot)
 	}
 
@@ -115,8 +175,8 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request) {
 	for _, got := range receivedBlobs {
 		log.Printf("Got blob: %v\n", got)
 		blob := make(map[string]interface{})
-		blob["blobRef"] = got.blobRef.String()
-		blob["size"] = got.size
+		blob["blobRef"] = got.BlobRef.String()
+		blob["size"] = got.Size
 		received = append(received, blob)
 	}
 	ret["received"] = received
@@ -124,13 +184,19 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request) {
 	if errText != "" {
 		ret["errorText"] = errText
 	}
+	if quotaExceeded {
+		ret["quotaExceeded"] = true
+	}
+	if len(partialFailures) > 0 {
+		ret["partialFailures"] = partialFailures
+	}
 
 	httputil.ReturnJson(conn, ret)
 }
 
 func commonUploadResponse(req *http.Request) map[string]interface{} {
 	ret := make(map[string]interface{})
-	ret["maxUploadSize"] = 2147483647 // 2GB.. *shrug*
+	ret["maxUploadSize"] = *flagMaxUploadSize
 	ret["uploadUrlExpirationSeconds"] = 86400
 	if len(req.Host) > 0 {
 		scheme := "http" // TODO: https
@@ -142,74 +208,13 @@ func commonUploadResponse(req *http.Request) map[string]interface{} {
 	return ret
 }
 
-func receiveBlob(blobRef *blobref.BlobRef, source io.Reader) (blobGot *receivedBlob, err os.Error) {
-	hashedDirectory := BlobDirectoryName(blobRef)
-	err = os.MkdirAll(hashedDirectory, 0700)
-	if err != nil {
-		return
-	}
-
-	var tempFile *os.File
-	tempFile, err = ioutil.TempFile(hashedDirectory, BlobFileBaseName(blobRef)+".tmp")
-	if err != nil {
-		return
-	}
-
-	success := false // set true later
-	defer func() {
-		if !success {
-			log.Println("Removing temp file: ", tempFile.Name())
-			os.Remove(tempFile.Name())
-		}
-	}()
-
-	hash := blobRef.Hash()
-	var written int64
-	written, err = io.Copy(io.MultiWriter(hash, tempFile), source)
-	if err != nil {
-		return
-	}
-	// TODO: fsync before close.
-	if err = tempFile.Close(); err != nil {
-		return
+func createPutHandler(storage uploadStorage) func(http.ResponseWriter, *http.Request) {
+	return func(conn http.ResponseWriter, req *http.Request) {
+		handlePut(conn, req, storage)
 	}
-
-	if !blobRef.HashMatches(hash) {
-		err = CorruptBlobError
-		return
-	}
-
-	fileName := BlobFileName(blobRef)
-	if err = os.Rename(tempFile.Name(), fileName); err != nil {
-		return
-	}
-
-	stat, err := os.Lstat(fileName)
-	if err != nil {
-		return
-	}
-	if !stat.IsRegular() || stat.Size != written {
-		err = os.NewError("Written size didn't match.")
-		return
-	}
-
-	blobGot = &receivedBlob{blobRef: blobRef, size: stat.Size}
-	success = true
-
-	if *flagOpenImages {
-		exec.Run("/usr/bin/eog",
-			[]string{"/usr/bin/eog", fileName},
-			os.Environ(),
-			"/",
-			exec.DevNull,
-			exec.DevNull,
-			exec.MergeWithStdout)
-	}
-
-	return
 }
 
-func handlePut(conn http.ResponseWriter, req *http.Request) {
+func handlePut(conn http.ResponseWriter, req *http.Request, storage uploadStorage) {
 	blobRef := BlobFromUrlPath(req.URL.Path)
 	if blobRef == nil {
 		httputil.BadRequestError(conn, "Malformed PUT URL.")
@@ -221,11 +226,36 @@ func handlePut(conn http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	_, err := receiveBlob(blobRef, req.Body)
-	if err != nil {
+	isNew := quota != nil && !haveBlob(storage, blobRef)
+	body := newLimitedBlobReader(req.Body)
+	blobGot, err := storage.ReceiveBlob(blobRef, body)
+	switch {
+	case body.err == blobTooLargeError:
+		discardPartialUploads(storage, blobRef)
+		httputil.BadRequestError(conn, fmt.Sprintf("Blob exceeds maxUploadSize of %d bytes", *flagMaxUploadSize))
+		return
+	case body.err == quotaExceededError:
+		discardPartialUploads(storage, blobRef)
+		quotaExceededResponse(conn, make(map[string]interface{}))
+		return
+	case err != nil:
 		httputil.ServerError(conn, err)
 		return
 	}
+	if isNew {
+		quota.add(blobGot.Size)
+	}
+	blobserver.GetHub(storage).NotifyBlobReceived(blobGot.BlobRef)
 
 	fmt.Fprint(conn, "OK")
 }
+
+// discardPartialUploads removes any partial uploads storage kept of a
+// blob that was refused.
+func discardPartialUploads(storage interface{}, blob *blobref.BlobRef) {
+	if ps, ok := storage.(blobserver.PartialUploadStorage); ok {
+		if err := ps.RemovePartialUploads(blob); err != nil {
+			log.Printf("Error removing partial uploads of %s: %v", blob, err)
+		}
+	}
+}